@@ -0,0 +1,44 @@
+// copy.js copies the value of a copy button (data-copy) to the clipboard, so IPs and domains
+// don't have to be selected in tables that scroll horizontally
+(function () {
+    // navigator.clipboard needs a secure context; plain HTTP falls back to a hidden textarea
+    function copy(text) {
+        if (navigator.clipboard && window.isSecureContext) {
+            return navigator.clipboard.writeText(text);
+        }
+        return new Promise(function (resolve, reject) {
+            var area = document.createElement('textarea');
+            area.value = text;
+            area.setAttribute('readonly', '');
+            area.style.position = 'fixed';
+            area.style.opacity = '0';
+            document.body.appendChild(area);
+            area.select();
+            var ok = document.execCommand('copy');
+            document.body.removeChild(area);
+            ok ? resolve() : reject(new Error('copy failed'));
+        });
+    }
+
+    // Briefly show the outcome on the button itself
+    function flash(button, label) {
+        clearTimeout(button.copyTimer);
+        button.textContent = label;
+        button.copyTimer = setTimeout(function () {
+            button.textContent = '⧉';
+        }, 1200);
+    }
+
+    document.addEventListener('click', function (event) {
+        var button = event.target.closest('button.copy-button[data-copy]');
+        if (!button) {
+            return;
+        }
+        event.preventDefault();
+        copy(button.getAttribute('data-copy')).then(function () {
+            flash(button, '✓');
+        }, function () {
+            flash(button, '✗');
+        });
+    });
+})();
@@ -0,0 +1,70 @@
+// live.js updates the overview cards from the /ws/stats WebSocket
+(function () {
+    // The WebSocket path includes server.base_path, so the server passes it in
+    var socketPath = document.currentScript.getAttribute('data-socket');
+    // display.locale, so numbers keep the separators the page was rendered with
+    var locale = document.currentScript.getAttribute('data-locale') || 'en-US';
+    var cards = document.querySelectorAll('[data-metric]');
+    if (!cards.length || !window.WebSocket) {
+        return;
+    }
+
+    // Mirror formatCount and formatDecimal in main.go
+    function formatCount(value) {
+        return value.toLocaleString(locale);
+    }
+
+    function formatDecimal(value, digits) {
+        return value.toLocaleString(locale, { minimumFractionDigits: digits, maximumFractionDigits: digits });
+    }
+
+    // Mirrors formatMilliseconds in main.go
+    function formatMilliseconds(ms) {
+        if (ms < 1) {
+            return formatDecimal(ms, 3) + ' ms';
+        }
+        if (ms < 100) {
+            return formatDecimal(ms, 2) + ' ms';
+        }
+        return formatDecimal(ms, 0) + ' ms';
+    }
+
+    var formatters = {
+        queries: formatCount,
+        blocked: formatCount,
+        blocked_percent: function (value) { return formatDecimal(value, 2) + '%'; },
+        avg_processing_ms: formatMilliseconds
+    };
+
+    // Shown above the cards while the live connection is down
+    var banner = document.createElement('div');
+    banner.className = 'flash flash-error';
+    banner.textContent = 'Live updates are unavailable, retrying…';
+    banner.hidden = true;
+    cards[0].closest('.overview-cards').before(banner);
+
+    function connect(delay) {
+        var scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+        var socket = new WebSocket(scheme + location.host + socketPath);
+
+        socket.onmessage = function (event) {
+            var summary = JSON.parse(event.data);
+            cards.forEach(function (card) {
+                var key = card.getAttribute('data-metric');
+                if (key in summary && formatters[key]) {
+                    card.textContent = formatters[key](summary[key]);
+                }
+            });
+            banner.hidden = true;
+            delay = 1000;
+        };
+
+        // Reconnect with backoff, e.g. after an Aghamon restart
+        socket.onclose = function () {
+            banner.hidden = false;
+            setTimeout(function () { connect(Math.min(delay * 2, 60000)); }, delay);
+        };
+    }
+
+    connect(1000);
+})();
@@ -0,0 +1,38 @@
+// loading.js shows a loading bar while the next page is being rendered, since every page
+// waits for AdGuard Home before the server responds
+(function () {
+    var timer;
+
+    // Only show the bar for slow loads so fast navigations don't flicker
+    function start() {
+        clearTimeout(timer);
+        timer = setTimeout(function () {
+            document.body.classList.add('loading');
+        }, 150);
+    }
+
+    function stop() {
+        clearTimeout(timer);
+        document.body.classList.remove('loading');
+    }
+
+    document.addEventListener('click', function (event) {
+        var link = event.target.closest('a[href]');
+        if (!link || event.defaultPrevented || event.button !== 0 ||
+            event.metaKey || event.ctrlKey || event.shiftKey || event.altKey ||
+            link.target || link.hasAttribute('download') ||
+            link.origin !== location.origin || link.hash && link.pathname === location.pathname) {
+            return;
+        }
+        start();
+    });
+
+    document.addEventListener('submit', function (event) {
+        if (!event.defaultPrevented) {
+            start();
+        }
+    });
+
+    // Pages restored from the back/forward cache must not keep showing the bar
+    window.addEventListener('pageshow', stop);
+})();
@@ -0,0 +1,18 @@
+// retry.js counts down the retry shown on the AdGuard Home unreachable page; the page's Refresh
+// header reloads it when the countdown ends, also without JavaScript
+(function () {
+    var retry = document.querySelector('[data-retry-in]');
+    if (!retry) {
+        return;
+    }
+    var seconds = parseInt(retry.getAttribute('data-retry-in'), 10);
+    var label = retry.querySelector('.retry-seconds');
+
+    var timer = setInterval(function () {
+        seconds = Math.max(seconds - 1, 0);
+        label.textContent = seconds;
+        if (seconds === 0) {
+            clearInterval(timer);
+        }
+    }, 1000);
+})();
@@ -1,17 +1,59 @@
 package main
 
 import (
+  "bytes"
+  "compress/gzip"
+  "compress/zlib"
+  "context"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
   "embed"
   "encoding/base64"
+  "encoding/hex"
   "encoding/json"
+  "errors"
+  "flag"
   "fmt"
   "html/template"
   "io"
+  "io/fs"
+  "maps"
+  "math"
+  "net"
   "net/http"
+  "net/netip"
+  "net/url"
   "os"
+  "os/signal"
+  "path"
+  "path/filepath"
+  "reflect"
+  "regexp"
+  "runtime"
+  "slices"
+  "sort"
+  "strconv"
   "strings"
+  "sync"
+  "sync/atomic"
+  "syscall"
+  "time"
+  "unicode"
+  "unicode/utf8"
   
+  "github.com/gorilla/websocket"
   "github.com/labstack/echo/v4"
+  "github.com/labstack/echo/v4/middleware"
+  "github.com/labstack/gommon/log"
+  "golang.org/x/crypto/acme/autocert"
+  "golang.org/x/sync/errgroup"
+  "golang.org/x/sync/semaphore"
+  "golang.org/x/text/language"
+  "golang.org/x/text/message"
+  "golang.org/x/text/number"
+  "golang.org/x/sync/singleflight"
+  "golang.org/x/time/rate"
   "gopkg.in/yaml.v3"
   _ "golang.org/x/crypto/x509roots/fallback"
   _ "time/tzdata"
@@ -23,450 +65,6372 @@ var templateFS embed.FS
 //go:embed assets/*
 var assetFS embed.FS
 
+// requiredTemplates are the embedded templates parsed at startup
+var requiredTemplates = []string{"templates/base.html", "templates/error.html", "templates/unavailable.html", "templates/print.html"}
+
+// requiredAssets are the embedded assets every page links to; base.html carries the styles
+var requiredAssets = []string{"assets/favicon.ico", "assets/logo_small.png", "assets/loading.js", "assets/copy.js", "assets/retry.js", "assets/live.js"}
+
+// missingEmbeds returns the names that are not files in fsys, so a build missing one fails at
+// startup instead of with a 404 on the first request
+func missingEmbeds(fsys fs.FS, names []string) []string {
+  var missing []string
+  for _, name := range names {
+    if info, err := fs.Stat(fsys, name); err != nil || info.IsDir() {
+      missing = append(missing, name)
+    }
+  }
+  return missing
+}
+
+// Build information, set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+  version = "dev"
+  commit  = "unknown"
+  date    = "unknown"
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+  Version   string `json:"version"`
+  Commit    string `json:"commit"`
+  Date      string `json:"date"`
+  GoVersion string `json:"go_version"`
+}
+
+// buildInfo returns the version information injected at build time
+func buildInfo() BuildInfo {
+  return BuildInfo{
+    Version:   version,
+    Commit:    commit,
+    Date:      date,
+    GoVersion: runtime.Version(),
+  }
+}
+
+// Link is a server.links quick link
+type Link struct {
+  Label string `yaml:"label"`
+  URL   string `yaml:"url"`
+}
+
 // Config represents the configuration structure
 type Config struct {
+  Include includeList `yaml:"include"` // more files decoded over this one, see decodeConfig
+
   AdGuard struct {
     ServerURL string `yaml:"server_url"`
     Username  string `yaml:"username"`
     Password  string `yaml:"password"`
+    Auth        string `yaml:"auth"`         // "basic" (default) or "token"
+    Token       string `yaml:"token"`        // static API token sent with auth: token
+    TokenHeader string `yaml:"token_header"` // header carrying the token, Authorization (as a Bearer token) when unset
+    InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+    CACertFile         string `yaml:"ca_cert_file"`
+    CacheTTL           int    `yaml:"cache_ttl"` // seconds, 0 disables caching
+    MaxResponseBytes   int64  `yaml:"max_response_bytes"`
+    Timeout            int    `yaml:"timeout"` // seconds a request may take, reading the response included; 0 uses the default
+    APIBasePath        string `yaml:"api_base_path"` // path of the control API, /control unless proxied under a prefix
+    PollInterval       int    `yaml:"poll_interval"` // seconds between background refreshes, 0 fetches on demand only
+    Headers            map[string]string `yaml:"headers"` // extra headers for every request, e.g. for an authenticating proxy
+    CircuitBreaker     struct {
+      Failures int `yaml:"failures"` // consecutive failures before requests fail fast
+      Cooldown int `yaml:"cooldown"` // seconds to fail fast before trying AdGuard Home again
+    } `yaml:"circuit_breaker"`
+    MaxConcurrentFetches int `yaml:"max_concurrent_fetches"` // requests to AdGuard Home in flight at once, 0 is unlimited
+    Version string `yaml:"version"` // AdGuard Home version to assume, e.g. v0.107.52, instead of detecting it
+    Transport struct {
+      MaxIdleConns        int `yaml:"max_idle_conns"`          // idle connections kept open, 0 uses the default
+      MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"` // of those, to AdGuard Home; 0 uses the default
+      IdleConnTimeout     int `yaml:"idle_conn_timeout"`       // seconds an idle connection is kept, 0 uses the default
+    } `yaml:"transport"`
   } `yaml:"adguard"`
-}
+  Server struct {
+    LogLevel string `yaml:"log_level"`
+    ReadOnly *bool  `yaml:"read_only"`
+    RateLimit *float64 `yaml:"rate_limit"` // requests per second per client IP, 0 disables
+    Timezone string `yaml:"timezone"` // IANA name used to display timestamps, UTC when unset
+    BasePath string `yaml:"base_path"` // URL prefix when served from a subpath behind a reverse proxy
+    LiveUpdates struct {
+      Interval       int `yaml:"interval"`        // seconds between pushes, 0 disables /ws/stats
+      MaxConnections int `yaml:"max_connections"` // concurrent /ws/stats connections
+    } `yaml:"live_updates"`
+    Brand struct {
+      Title   string `yaml:"title"`
+      LogoURL string `yaml:"logo_url"`
+    } `yaml:"brand"`
+    Links []Link `yaml:"links"` // quick links shown on the home page
+    Theme string `yaml:"theme"` // color theme from themes, default when unset
+    TLS struct {
+      CertFile   string `yaml:"cert_file"`
+      KeyFile    string `yaml:"key_file"`
+      AutoDomain string `yaml:"auto_domain"`
+      CacheDir   string `yaml:"cache_dir"`
+    } `yaml:"tls"`
+    CORS struct {
+      AllowedOrigins []string `yaml:"allowed_origins"` // origins allowed to call /api/*, none when empty
+    } `yaml:"cors"`
+    TrustedProxies []string `yaml:"trusted_proxies"` // proxy IPs or CIDR ranges whose X-Forwarded-For is trusted
+    Log struct {
+      SkipPaths []string `yaml:"skip_paths"` // path prefixes left out of the request log, nil uses the default
+    } `yaml:"log"`
+    AllowIndexing bool `yaml:"allow_indexing"` // let search engines index the dashboard, see robotsTxt
+    DebugTimings bool `yaml:"debug_timings"` // send a Server-Timing header with the fetch and render time of each page
+  } `yaml:"server"`
 
-// Client represents a DNS client from AdGuard Home
-type Client struct {
-  IP       string `json:"ip"`
-  Name     string `json:"name"`
-  Source   string `json:"source"`
-  WhoisInfo struct {
-    Country string `json:"country"`
-    OrgName string `json:"orgname"`
-    City    string `json:"city"`
-  } `json:"whois_info"`
+  Display struct {
+    HideClients []string `yaml:"hide_clients"` // IPs, CIDR ranges or name/IP glob patterns to hide
+    OnlyClients []string `yaml:"only_clients"` // when set, only matching clients are shown
+    PinnedClients []string `yaml:"pinned_clients"` // client IPs kept at the top of the clients table, highlighted
+    ClientColumns []string `yaml:"client_columns"` // clients table columns in order, see clientColumnHeaders
+    MaxRows int `yaml:"max_rows"` // most rows rendered in any table, 0 uses the default
+    BlockedClientsSample int `yaml:"blocked_clients_sample"` // recent blocked queries behind "Most Blocked Clients", 0 uses the default
+    LatencyBuckets []float64 `yaml:"latency_buckets"` // upstream latency histogram boundaries in ms, empty uses the default
+    AnonymizeIPs bool `yaml:"anonymize_ips"` // mask client IPs on the pages, see anonymizeIP
+    Locale string `yaml:"locale"` // BCP 47 tag for number formatting, e.g. de-DE; en-US when unset
+    InlineBars bool `yaml:"inline_bars"` // draw a bar behind each count in the top tables
+    StatsMismatchThreshold float64 `yaml:"stats_mismatch_threshold"` // percent the query series may differ from the total, 0 uses the default
+    SourceLabels map[string]string `yaml:"source_labels"` // client source labels on top of defaultSourceLabels, by lowercase source
+  } `yaml:"display"`
+
+  // location is the loaded server.timezone
+  location *time.Location
+  // printer formats numbers for display.locale
+  printer *message.Printer
+  // sourceLabels are defaultSourceLabels with display.source_labels applied, by lowercase source
+  sourceLabels map[string]string
 }
 
-// ClientsResponse represents the response from AdGuard Home API
-type ClientsResponse struct {
-  Clients        []Client `json:"clients"`
-  AutoClients    []Client `json:"auto_clients"`
-  SupportedTags  []string `json:"supported_tags"`
+// basePath returns the normalized URL prefix without a trailing slash, "" when served from the root
+func (c *Config) basePath() string {
+  return strings.TrimSuffix("/"+strings.Trim(c.Server.BasePath, "/"), "/")
 }
 
-// StatsResponse represents the response from AdGuard Home stats API
-type StatsResponse struct {
-  TimeUnits          string              `json:"time_units"`
-  TopQueriedDomains  []map[string]int    `json:"top_queried_domains"`
-  TopClients         []map[string]int    `json:"top_clients"`
-  TopBlockedDomains  []map[string]int    `json:"top_blocked_domains"`
-  TopUpstreamsResponses []map[string]int `json:"top_upstreams_responses"`
-  TopUpstreamsAvgTime []map[string]float64 `json:"top_upstreams_avg_time"`
-  DNSQueries         []int               `json:"dns_queries"`
-  BlockedFiltering   []int               `json:"blocked_filtering"`
-  NumDNSQueries      int                 `json:"num_dns_queries"`
-  NumBlockedFiltering int                `json:"num_blocked_filtering"`
-  AvgProcessingTime  float64             `json:"avg_processing_time"`
+// appURL returns path prefixed with the configured base path
+func appURL(path string) string {
+  return currentConfig().basePath() + path
 }
 
-// Template represents the template structure
-type Template struct {
-  templates *template.Template
+// timezone returns the location timestamps are displayed in
+func (c *Config) timezone() *time.Location {
+  if c.location == nil {
+    return time.UTC
+  }
+  return c.location
 }
 
-// Render implements the echo.Renderer interface
-func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-  return t.templates.ExecuteTemplate(w, name, data)
+// debug reports whether the server is configured for debug logging
+func (c *Config) debug() bool {
+  return strings.EqualFold(c.Server.LogLevel, "debug")
 }
 
-// loadConfig loads the configuration from config.yaml
-func loadConfig() (*Config, error) {
-  file, err := os.Open("config.yaml")
-  if err != nil {
-    return nil, err
+// brandTitle returns the configured dashboard title, defaulting to Aghamon
+func (c *Config) brandTitle() string {
+  if c.Server.Brand.Title != "" {
+    return c.Server.Brand.Title
   }
-  defer file.Close()
+  return "Aghamon"
+}
 
-  var config Config
-  decoder := yaml.NewDecoder(file)
-  if err := decoder.Decode(&config); err != nil {
-    return nil, err
+// brandLogoURL returns the configured logo URL, defaulting to the embedded logo
+func (c *Config) brandLogoURL() string {
+  if c.Server.Brand.LogoURL != "" {
+    return c.Server.Brand.LogoURL
   }
+  return c.basePath() + "/static/logo_small.png"
+}
 
-  return &config, nil
+// AdGuard Home authentication modes for adguard.auth
+const (
+  authBasic = "basic"
+  authToken = "token"
+)
+
+// authMode returns adguard.auth, defaulting to basic
+func (c *Config) authMode() string {
+  if c.AdGuard.Auth == "" {
+    return authBasic
+  }
+  return c.AdGuard.Auth
 }
 
-// getBasicAuth returns the base64 encoded basic auth string
-func getBasicAuth(username, password string) string {
-  auth := username + ":" + password
-  return base64.StdEncoding.EncodeToString([]byte(auth))
+// tokenHeader returns the header the token is sent in, Authorization unless adguard.token_header is set
+func (c *Config) tokenHeader() string {
+  if c.AdGuard.TokenHeader == "" {
+    return "Authorization"
+  }
+  return c.AdGuard.TokenHeader
 }
 
-// fetchClients fetches client data from AdGuard Home API
-func fetchClients(config *Config) (*ClientsResponse, error) {
-  client := &http.Client{}
-  
-  url := fmt.Sprintf("%s/control/clients", config.AdGuard.ServerURL)
-  req, err := http.NewRequest("GET", url, nil)
-  if err != nil {
-    return nil, err
+// tokenValue returns the token header value: a Bearer token in Authorization, the bare token in
+// any other header
+func (c *Config) tokenValue() string {
+  if strings.EqualFold(c.tokenHeader(), "Authorization") {
+    return "Bearer " + c.AdGuard.Token
   }
+  return c.AdGuard.Token
+}
 
-  authHeader := getBasicAuth(config.AdGuard.Username, config.AdGuard.Password)
-  req.Header.Set("Authorization", "Basic "+authHeader)
-  req.Header.Set("Accept", "application/json")
-  req.Header.Set("Referer", config.AdGuard.ServerURL+"/")
+// themes are the server.theme values, each a set of CSS colors in templates/base.html
+var themes = []string{"default", "solarized", "high-contrast"}
 
-  resp, err := client.Do(req)
-  if err != nil {
-    return nil, err
+// theme returns the configured color theme, defaulting to "default"
+func (c *Config) theme() string {
+  if c.Server.Theme == "" {
+    return "default"
   }
-  defer resp.Body.Close()
+  return c.Server.Theme
+}
 
-  body, err := io.ReadAll(resp.Body)
-  if err != nil {
-    return nil, err
+// readOnly reports whether mutating routes are disabled, which is the default
+func (c *Config) readOnly() bool {
+  return c.Server.ReadOnly == nil || *c.Server.ReadOnly
+}
+
+// rateLimit returns the per-client request rate limit, defaulting to 20 requests per second
+func (c *Config) rateLimit() float64 {
+  if c.Server.RateLimit == nil {
+    return 20
   }
+  return *c.Server.RateLimit
+}
 
-  var clientsResponse ClientsResponse
-  if err := json.Unmarshal(body, &clientsResponse); err != nil {
-    return nil, err
+// cacheTTL returns how long AdGuard Home responses may be served from the cache. With background
+// polling, entries stay fresh for two poll intervals so one failed poll falls back to fetching on demand.
+func (c *Config) cacheTTL() time.Duration {
+  ttl := time.Duration(c.AdGuard.CacheTTL) * time.Second
+  if poll := 2 * c.pollInterval(); poll > ttl {
+    return poll
   }
+  return ttl
+}
 
-  return &clientsResponse, nil
+// pollInterval returns how often the background poller refreshes the cache, 0 when disabled
+func (c *Config) pollInterval() time.Duration {
+  return time.Duration(c.AdGuard.PollInterval) * time.Second
 }
 
-// fetchStats fetches stats data from AdGuard Home API
-func fetchStats(config *Config) (*StatsResponse, error) {
-  client := &http.Client{}
-  
-  url := fmt.Sprintf("%s/control/stats", config.AdGuard.ServerURL)
-  req, err := http.NewRequest("GET", url, nil)
-  if err != nil {
-    return nil, err
-  }
+// unixSocketPrefix marks an adguard.server_url that is a Unix domain socket path, e.g. unix:///run/adguard.sock
+const unixSocketPrefix = "unix://"
 
-  authHeader := getBasicAuth(config.AdGuard.Username, config.AdGuard.Password)
-  req.Header.Set("Authorization", "Basic "+authHeader)
-  req.Header.Set("Accept", "application/json")
-  req.Header.Set("Referer", config.AdGuard.ServerURL+"/")
+// unixSocketHost is the placeholder host of requests sent over a Unix domain socket
+const unixSocketHost = "localhost"
 
-  resp, err := client.Do(req)
-  if err != nil {
-    return nil, err
+// unixSocket returns the Unix domain socket path of adguard.server_url, "" when it is an HTTP(S) URL
+func (c *Config) unixSocket() string {
+  if !strings.HasPrefix(c.AdGuard.ServerURL, unixSocketPrefix) {
+    return ""
   }
-  defer resp.Body.Close()
+  return strings.TrimPrefix(c.AdGuard.ServerURL, unixSocketPrefix)
+}
 
-  body, err := io.ReadAll(resp.Body)
-  if err != nil {
-    return nil, err
+// serverURL returns the AdGuard Home URL requests are built on, without a trailing slash; over a
+// Unix domain socket the host is a placeholder, as the socket path leaves no room for URL paths
+func (c *Config) serverURL() string {
+  if c.unixSocket() != "" {
+    return "http://" + unixSocketHost
   }
+  return strings.TrimSuffix(c.AdGuard.ServerURL, "/")
+}
 
-  var statsResponse StatsResponse
-  if err := json.Unmarshal(body, &statsResponse); err != nil {
-    return nil, err
+// apiBasePath returns the normalized control API path without a trailing slash
+func (c *Config) apiBasePath() string {
+  if c.AdGuard.APIBasePath == "" {
+    return "/control"
   }
-
-  return &statsResponse, nil
+  return strings.TrimSuffix("/"+strings.Trim(c.AdGuard.APIBasePath, "/"), "/")
 }
 
-// generateHTMLTable generates an HTML table from the clients data
-func generateHTMLTable(clients []Client) string {
-  var sb strings.Builder
-  
-  sb.WriteString(`<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
-    <thead>
-      <tr>
-        <th>IP Address</th>
-        <th>Name</th>
-        <th>Source</th>
-        <th>Country</th>
-        <th>Organization</th>
-        <th>City</th>
-      </tr>
-    </thead>
-    <tbody>`)
+// defaultMaxResponseBytes caps AdGuard Home response bodies unless adguard.max_response_bytes is set
+const defaultMaxResponseBytes = 10 << 20
 
-  for _, client := range clients {
-    sb.WriteString(fmt.Sprintf(`
-      <tr>
-        <td>%s</td>
-        <td>%s</td>
-        <td>%s</td>
-        <td>%s</td>
-        <td>%s</td>
-        <td>%s</td>
-      </tr>`,
-      client.IP,
-      client.Name,
-      client.Source,
-      client.WhoisInfo.Country,
-      client.WhoisInfo.OrgName,
-      client.WhoisInfo.City,
-    ))
+// maxResponseBytes returns the largest AdGuard Home response body that will be read
+func (c *Config) maxResponseBytes() int64 {
+  if c.AdGuard.MaxResponseBytes == 0 {
+    return defaultMaxResponseBytes
   }
+  return c.AdGuard.MaxResponseBytes
+}
 
-  sb.WriteString(`</tbody></table></div>`)
-  return sb.String()
+// Connection pool defaults used when adguard.transport is not set. Go's own per-host default of 2
+// idle connections is too few when pages fan out several requests while the poller runs.
+const (
+  defaultMaxIdleConns        = 100
+  defaultMaxIdleConnsPerHost = 10
+  defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// maxIdleConns returns how many idle connections the AdGuard Home client keeps open in total
+func (c *Config) maxIdleConns() int {
+  if c.AdGuard.Transport.MaxIdleConns == 0 {
+    return defaultMaxIdleConns
+  }
+  return c.AdGuard.Transport.MaxIdleConns
 }
 
-// generateStatsTable generates an HTML table for stats data
-func generateStatsTable(title string, data []map[string]int, valueLabel string) string {
-  var sb strings.Builder
-  
-  sb.WriteString(fmt.Sprintf(`<h3>%s</h3>`, title))
-  sb.WriteString(`<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
-    <thead>
-      <tr>
-        <th>#</th>
-        <th>Name</th>
-        <th style="text-align: right;">` + valueLabel + `</th>
-      </tr>
-    </thead>
-    <tbody>`)
+// maxIdleConnsPerHost returns how many idle connections to AdGuard Home are kept for reuse
+func (c *Config) maxIdleConnsPerHost() int {
+  if c.AdGuard.Transport.MaxIdleConnsPerHost == 0 {
+    return defaultMaxIdleConnsPerHost
+  }
+  return c.AdGuard.Transport.MaxIdleConnsPerHost
+}
 
-  for i, item := range data {
-    for key, value := range item {
-      sb.WriteString(fmt.Sprintf(`
-        <tr>
-          <td>%d</td>
-          <td>%s</td>
-          <td style="text-align: right;">%d</td>
-        </tr>`,
-        i+1,
-        key,
-        value,
-      ))
-      break // Only one key-value pair per map
-    }
+// idleConnTimeout returns how long an idle connection to AdGuard Home is kept for reuse
+func (c *Config) idleConnTimeout() time.Duration {
+  if c.AdGuard.Transport.IdleConnTimeout == 0 {
+    return defaultIdleConnTimeout
   }
+  return time.Duration(c.AdGuard.Transport.IdleConnTimeout) * time.Second
+}
 
-  sb.WriteString(`</tbody></table></div>`)
-  return sb.String()
+// defaultTimeout bounds each AdGuard Home request unless adguard.timeout is set
+const defaultTimeout = 30 * time.Second
+
+// timeout returns how long a request to AdGuard Home may take before it fails
+func (c *Config) timeout() time.Duration {
+  if c.AdGuard.Timeout == 0 {
+    return defaultTimeout
+  }
+  return time.Duration(c.AdGuard.Timeout) * time.Second
 }
 
-// generateUpstreamsTable generates an HTML table for upstreams data
-func generateUpstreamsTable(title string, data []map[string]float64, valueLabel string) string {
-  var sb strings.Builder
-  
-  sb.WriteString(fmt.Sprintf(`<h3>%s</h3>`, title))
-  sb.WriteString(`<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
-    <thead>
-      <tr>
-        <th>#</th>
-        <th>Upstream</th>
-        <th style="text-align: right;">` + valueLabel + `</th>
-      </tr>
-    </thead>
-    <tbody>`)
+// Circuit breaker defaults used when adguard.circuit_breaker is not set
+const (
+  defaultBreakerFailures = 5
+  defaultBreakerCooldown = 30 * time.Second
+)
 
-  for i, item := range data {
-    for key, value := range item {
-      sb.WriteString(fmt.Sprintf(`
-        <tr>
-          <td>%d</td>
-          <td>%s</td>
-          <td style="text-align: right;">%.6f</td>
-        </tr>`,
-        i+1,
-        key,
-        value,
-      ))
-      break // Only one key-value pair per map
-    }
+// breakerFailures returns how many consecutive failures open the circuit breaker
+func (c *Config) breakerFailures() int {
+  if c.AdGuard.CircuitBreaker.Failures == 0 {
+    return defaultBreakerFailures
   }
+  return c.AdGuard.CircuitBreaker.Failures
+}
 
-  sb.WriteString(`</tbody></table></div>`)
-  return sb.String()
+// breakerCooldown returns how long the open circuit breaker fails fast
+func (c *Config) breakerCooldown() time.Duration {
+  if c.AdGuard.CircuitBreaker.Cooldown == 0 {
+    return defaultBreakerCooldown
+  }
+  return time.Duration(c.AdGuard.CircuitBreaker.Cooldown) * time.Second
 }
 
-// generateHomeContent generates the home page content
-func generateHomeContent() string {
-  return `<h1>Welcome to Aghamon</h1>
-<p>Monitor your DNS queries, clients, and upstream performance in real-time.</p>
+// clientColumnHeaders maps display.client_columns names to their clients table header
+var clientColumnHeaders = map[string]string{
+  "ip":           "IP Address",
+  "name":         "Name",
+  "source":       "Source",
+  "country":      "Country",
+  "organization": "Organization",
+  "city":         "City",
+  "queries":      "Queries",
+  "tags":         "Tags",
+  "type":         "Type",
+}
 
-<div style="display: grid; grid-template-columns: repeat(auto-fit, minmax(250px, 1fr)); gap: 20px; margin-top: 30px;">
-    <div style="background: #e8f4fd; padding: 20px; border-radius: 5px; text-align: center;">
-        <h3>📱 Clients</h3>
-        <p>View connected DNS clients and their information</p>
-        <a href="/clients" style="display: inline-block; background: #3498db; color: white; padding: 10px 20px; text-decoration: none; border-radius: 3px;">View Clients</a>
-    </div>
-    
-    <div style="background: #e8f6f3; padding: 20px; border-radius: 5px; text-align: center;">
-        <h3>📊 Statistics</h3>
-        <p>DNS query statistics and blocked domains</p>
-        <a href="/stats" style="display: inline-block; background: #27ae60; color: white; padding: 10px 20px; text-decoration: none; border-radius: 3px;">View Stats</a>
-    </div>
-    
-    <div style="background: #fef9e7; padding: 20px; border-radius: 5px; text-align: center;">
-        <h3>🌐 Upstreams</h3>
-        <p>DNS upstream performance and response times</p>
-        <a href="/upstreams" style="display: inline-block; background: #f39c12; color: white; padding: 10px 20px; text-decoration: none; border-radius: 3px;">View Upstreams</a>
-    </div>
-</div>`
+// defaultClientColumns are the clients table columns shown when display.client_columns is unset
+var defaultClientColumns = []string{"ip", "name", "type", "source", "country", "organization", "city", "tags"}
+
+// clientColumns returns the clients table columns in display order
+func (c *Config) clientColumns() []string {
+  if len(c.Display.ClientColumns) == 0 {
+    return defaultClientColumns
+  }
+  return c.Display.ClientColumns
 }
 
-// generateClientsContent generates the clients page content
-func generateClientsContent(totalClients int, clientsTable string) string {
-  return fmt.Sprintf(`<div class="header-section">
-    <h1>DNS Clients</h1>
-    <p>Total clients: %d</p>
-</div>
-%s`, totalClients, clientsTable)
+// defaultSourceLabels are the labels shown for AdGuard Home's client sources, by lowercase source.
+// Both the older and the newer spelling of the hosts file source are covered.
+var defaultSourceLabels = map[string]string{
+  "persistent": "Persistent",
+  "runtime":    "Runtime",
+  "dhcp":       "DHCP",
+  "arp":        "ARP",
+  "rdns":       "Reverse DNS",
+  "whois":      "WHOIS",
+  "etc_hosts":  "Hosts file",
+  "etc/hosts":  "Hosts file",
 }
 
-// generateStatsContent generates the stats page content
-func generateStatsContent(timeUnits string, numDNSQueries, numBlockedFiltering int, avgProcessingTime float64, topDomainsTable, topClientsTable, topBlockedTable string) string {
-  return fmt.Sprintf(`<div class="header-section">
-    <h1>DNS Statistics</h1>
-</div>
+// sourceLabel returns the label for a client source, the source itself when it has none
+func (c *Config) sourceLabel(source string) string {
+  if label, ok := c.sourceLabels[strings.ToLower(source)]; ok {
+    return label
+  }
+  return source
+}
 
-<div class="summary">
-    <p><strong>Time Period:</strong> Last 24 %s</p>
-    <p><strong>Total DNS Queries:</strong> %d</p>
-    <p><strong>Total Blocked Queries:</strong> %d</p>
-    <p><strong>Average Processing Time:</strong> %.6f seconds</p>
-</div>
+// defaultMaxRows caps every rendered table unless display.max_rows is set
+const defaultMaxRows = 1000
 
-%s
-%s
-%s`, timeUnits, numDNSQueries, numBlockedFiltering, avgProcessingTime, topDomainsTable, topClientsTable, topBlockedTable)
+// maxRows returns the most rows a table may render, regardless of pagination or ?top=
+func (c *Config) maxRows() int {
+  if c.Display.MaxRows == 0 {
+    return defaultMaxRows
+  }
+  return c.Display.MaxRows
 }
 
-// generateUpstreamsContent generates the upstreams page content
-func generateUpstreamsContent(topUpstreamsTable, topUpstreamsTimeTable string) string {
-  return fmt.Sprintf(`<div class="header-section">
-    <h1>DNS Upstreams</h1>
-</div>
+// defaultBlockedClientsSample is how many recent blocked queries "Most Blocked Clients" is computed from
+const defaultBlockedClientsSample = 1000
 
-%s
-%s`, topUpstreamsTable, topUpstreamsTimeTable)
+// blockedClientsSample returns how many recent blocked queries are sampled per client
+func (c *Config) blockedClientsSample() int {
+  if c.Display.BlockedClientsSample == 0 {
+    return defaultBlockedClientsSample
+  }
+  return c.Display.BlockedClientsSample
 }
 
-// serveStaticFile serves embedded static files
-func serveStaticFile(c echo.Context) error {
-  path := c.Param("file")
-  if path == "" {
-    path = "index.html"
+// defaultLatencyBuckets are the upstream latency histogram boundaries in milliseconds unless
+// display.latency_buckets is set: <10, 10–50, 50–200 and ≥200 ms
+var defaultLatencyBuckets = []float64{10, 50, 200}
+
+// latencyBuckets returns the upstream latency histogram boundaries in milliseconds
+func (c *Config) latencyBuckets() []float64 {
+  if len(c.Display.LatencyBuckets) == 0 {
+    return defaultLatencyBuckets
   }
-  
-  // Security: Only serve files from assets directory
-  if strings.Contains(path, "..") {
-    return c.String(http.StatusForbidden, "Forbidden")
+  return c.Display.LatencyBuckets
+}
+
+// defaultStatsMismatchThreshold is how many percent the sum of the query series may differ from
+// the total number of queries before /stats flags it
+const defaultStatsMismatchThreshold = 1.0
+
+// statsMismatchThreshold returns the percentage of display.stats_mismatch_threshold
+func (c *Config) statsMismatchThreshold() float64 {
+  if c.Display.StatsMismatchThreshold == 0 {
+    return defaultStatsMismatchThreshold
   }
-  
-  data, err := assetFS.ReadFile("assets/" + path)
-  if err != nil {
-    return c.String(http.StatusNotFound, "File not found")
+  return c.Display.StatsMismatchThreshold
+}
+
+// defaultLogSkipPaths are the path prefixes left out of the request log unless server.log.skip_paths
+// is set: health checks, metrics scrapes and static assets
+var defaultLogSkipPaths = []string{"/healthz", "/metrics", "/static"}
+
+// logSkipPaths returns the path prefixes, relative to the base path, that are not request logged.
+// An explicitly empty server.log.skip_paths logs every request.
+func (c *Config) logSkipPaths() []string {
+  if c.Server.Log.SkipPaths == nil {
+    return defaultLogSkipPaths
   }
-  
-  // Set appropriate content type based on file extension
-  contentType := "application/octet-stream"
-  if strings.HasSuffix(path, ".png") {
-    contentType = "image/png"
-  } else if strings.HasSuffix(path, ".jpg") || strings.HasSuffix(path, ".jpeg") {
-    contentType = "image/jpeg"
-  } else if strings.HasSuffix(path, ".css") {
-    contentType = "text/css"
-  } else if strings.HasSuffix(path, ".js") {
-    contentType = "application/javascript"
+  return c.Server.Log.SkipPaths
+}
+
+// skipRequestLog reports whether path, relative to the base path, matches one of prefixes on a
+// segment boundary, so /static skips /static/live.js but not /statistics
+func skipRequestLog(path string, prefixes []string) bool {
+  for _, prefix := range prefixes {
+    prefix = strings.TrimSuffix(prefix, "/")
+    if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+      return true
+    }
   }
-  
-  return c.Blob(http.StatusOK, contentType, data)
+  return false
 }
 
-func main() {
-  e := echo.New()
-  
-  // Load configuration
-  config, err := loadConfig()
-  if err != nil {
-    e.Logger.Fatal("Failed to load config:", err)
+// logLevels maps server.log_level values to echo logger levels
+var logLevels = map[string]log.Lvl{
+  "debug": log.DEBUG,
+  "info":  log.INFO,
+  "warn":  log.WARN,
+  "error": log.ERROR,
+}
+
+// logLevel returns the configured logger level, defaulting to info
+func (c *Config) logLevel() log.Lvl {
+  if lvl, ok := logLevels[strings.ToLower(c.Server.LogLevel)]; ok {
+    return lvl
   }
+  return log.INFO
+}
 
-  // Parse embedded templates
-  templateContent, err := templateFS.ReadFile("templates/base.html")
+// redactedSecret replaces secrets in the /debug/config output
+const redactedSecret = "****"
+
+// redactedConfig returns the configuration as it was decoded, keyed like the YAML file, with the
+// password, token and header values replaced by redactedSecret, plus the effective value of each setting
+// that has a default
+func redactedConfig(c *Config) (map[string]interface{}, error) {
+  data, err := yaml.Marshal(c)
   if err != nil {
-    e.Logger.Fatal("Failed to read embedded template:", err)
+    return nil, err
   }
-  
-  // Setup template renderer with embedded templates
-  t := &Template{
-    templates: template.Must(template.New("base.html").Parse(string(templateContent))),
+  decoded := map[string]interface{}{}
+  if err := yaml.Unmarshal(data, &decoded); err != nil {
+    return nil, err
   }
-  e.Renderer = t
-
-  // Serve static files from embedded assets
-  e.GET("/static/:file", serveStaticFile)
-  e.GET("/static/", serveStaticFile)
 
-  e.GET("/", func(c echo.Context) error {
-    return c.Render(http.StatusOK, "base.html", map[string]interface{}{
-      "Title": "Aghamon",
-      "Content": template.HTML(generateHomeContent()),
-    })
-  })
-
-  e.GET("/clients", func(c echo.Context) error {
-    // Fetch clients from AdGuard Home
-    clientsResponse, err := fetchClients(config)
-    if err != nil {
-      return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching clients: %v", err))
+  if adguard, ok := decoded["adguard"].(map[string]interface{}); ok {
+    for _, key := range []string{"password", "token"} {
+      if secret, _ := adguard[key].(string); secret != "" {
+        adguard[key] = redactedSecret
+      }
+    }
+    if headers, ok := adguard["headers"].(map[string]interface{}); ok {
+      for name := range headers {
+        headers[name] = redactedSecret
+      }
     }
+  }
 
-    // Combine both clients and auto_clients
-    var allClients []Client
-    allClients = append(allClients, clientsResponse.Clients...)
-    allClients = append(allClients, clientsResponse.AutoClients...)
+  level := "info"
+  for name, lvl := range logLevels {
+    if lvl == c.logLevel() {
+      level = name
+    }
+  }
 
-    // Generate HTML table
-    htmlTable := generateHTMLTable(allClients)
+  return map[string]interface{}{
+    "config": decoded,
+    "effective": map[string]interface{}{
+      "api_base_path":          c.apiBasePath(),
+      "auth":                   c.authMode(),
+      "base_path":              c.basePath(),
+      "blocked_clients_sample": c.blockedClientsSample(),
+      "cache_ttl":              c.cacheTTL().String(),
+      "circuit_breaker_cooldown": c.breakerCooldown().String(),
+      "circuit_breaker_failures": c.breakerFailures(),
+      "client_columns":         c.clientColumns(),
+      "latency_buckets":        c.latencyBuckets(),
+      "locale":                 c.locale(),
+      "log_level":              level,
+      "max_response_bytes":     c.maxResponseBytes(),
+      "max_rows":               c.maxRows(),
+      "poll_interval":          c.pollInterval().String(),
+      "rate_limit":             c.rateLimit(),
+      "read_only":              c.readOnly(),
+      "stats_mismatch_threshold": c.statsMismatchThreshold(),
+      "theme":                  c.theme(),
+      "timezone":               c.timezone().String(),
+      "token_header":           c.tokenHeader(),
+      "transport_idle_conn_timeout": c.idleConnTimeout().String(),
+      "transport_max_idle_conns": c.maxIdleConns(),
+      "transport_max_idle_conns_per_host": c.maxIdleConnsPerHost(),
+    },
+  }, nil
+}
 
-    return c.Render(http.StatusOK, "base.html", map[string]interface{}{
-      "Title": "DNS Clients - Aghamon",
-      "Content": template.HTML(generateClientsContent(len(allClients), htmlTable)),
-    })
+// Client represents a DNS client from AdGuard Home
+type Client struct {
+  IP       string `json:"ip"`
+  Name     string `json:"name"`
+  Source   string `json:"source"`
+  Tags     []string `json:"tags"`
+  Type     string   `json:"type,omitempty"` // clientTypeConfigured or clientTypeAuto, set by visibleClients
+  WhoisInfo WhoisInfo `json:"whois_info"`
+}
+
+// WhoisInfo is the whois information AdGuard Home reports for a client
+type WhoisInfo struct {
+  Country string `json:"country"`
+  OrgName string `json:"orgname"`
+  City    string `json:"city"`
+}
+
+// whoisLookup looks up whois information for an IP
+type whoisLookup func(ip string) (WhoisInfo, error)
+
+// whoisSource fills in whois information for clients AdGuard Home has none for. No source is
+// built in, so enrichment is off unless one is set.
+var whoisSource whoisLookup
+
+// whoisCacheTTL is how long a whois lookup is reused for the same IP, including failed ones
+const whoisCacheTTL = 24 * time.Hour
+
+// enrichWhois fills empty whois information in clients from whoisSource, when one is set
+func enrichWhois(clients []Client) {
+  if whoisSource == nil {
+    return
+  }
+  for i := range clients {
+    if clients[i].WhoisInfo != (WhoisInfo{}) {
+      continue
+    }
+    ip := clients[i].IP
+    entry, err := cache.load(context.Background(), "whois:"+ip, whoisCacheTTL, func(context.Context) (interface{}, error) {
+      // A failed lookup is cached as empty so the IP isn't looked up on every page load
+      info, err := whoisSource(ip)
+      if err != nil {
+        return WhoisInfo{}, nil
+      }
+      return info, nil
+    })
+    if err == nil {
+      clients[i].WhoisInfo = entry.value.(WhoisInfo)
+    }
+  }
+}
+
+// Client types: configured clients are AdGuard Home's persistent clients with their own settings,
+// auto clients are only observed (rDNS, ARP, WHOIS, /etc/hosts, ...)
+const (
+  clientTypeConfigured = "configured"
+  clientTypeAuto       = "auto"
+)
+
+// clientTypeLabels maps client types to their display label
+var clientTypeLabels = map[string]string{
+  clientTypeConfigured: "Configured",
+  clientTypeAuto:       "Auto",
+}
+
+// ClientsResponse represents the response from AdGuard Home API
+type ClientsResponse struct {
+  Clients        []Client `json:"clients"`
+  AutoClients    []Client `json:"auto_clients"`
+  SupportedTags  []string `json:"supported_tags"`
+}
+
+// StatsResponse represents the response from AdGuard Home stats API
+type StatsResponse struct {
+  TimeUnits          string              `json:"time_units"`
+  TopQueriedDomains  []map[string]int    `json:"top_queried_domains"`
+  TopClients         []map[string]int    `json:"top_clients"`
+  TopBlockedDomains  []map[string]int    `json:"top_blocked_domains"`
+  TopUpstreamsResponses []map[string]int `json:"top_upstreams_responses"`
+  TopUpstreamsAvgTime []map[string]float64 `json:"top_upstreams_avg_time"`
+  DNSQueries         []int               `json:"dns_queries"`
+  BlockedFiltering   []int               `json:"blocked_filtering"`
+  NumDNSQueries      int                 `json:"num_dns_queries"`
+  NumBlockedFiltering int                `json:"num_blocked_filtering"`
+  AvgProcessingTime  float64             `json:"avg_processing_time"`
+
+  // Skipped lists fields that had an unexpected type and were left at their zero value
+  Skipped []string `json:"-"`
+}
+
+// UnmarshalJSON decodes the stats field by field. The response shape differs slightly between
+// AdGuard Home versions, so a field with an unexpected type is skipped instead of failing the
+// whole response; missing and null fields keep their zero value.
+func (s *StatsResponse) UnmarshalJSON(data []byte) error {
+  skipped, err := unmarshalLenient(data, s)
+  s.Skipped = skipped
+  return err
+}
+
+// unmarshalLenient decodes a JSON object into the struct pointed to by v one field at a time,
+// leaving fields that fail to decode at their zero value. It returns the JSON names of those
+// fields. Unknown fields are ignored, as with encoding/json.
+func unmarshalLenient(data []byte, v interface{}) ([]string, error) {
+  var fields map[string]json.RawMessage
+  if err := json.Unmarshal(data, &fields); err != nil {
+    return nil, err
+  }
+
+  var skipped []string
+  rv := reflect.ValueOf(v).Elem()
+  rt := rv.Type()
+  for i := 0; i < rt.NumField(); i++ {
+    name, _, _ := strings.Cut(rt.Field(i).Tag.Get("json"), ",")
+    raw, ok := fields[name]
+    if name == "" || name == "-" || !ok {
+      continue
+    }
+
+    // Decode into a fresh value so a half-decoded field is never kept
+    value := reflect.New(rt.Field(i).Type)
+    if err := json.Unmarshal(raw, value.Interface()); err != nil {
+      skipped = append(skipped, name)
+      continue
+    }
+    rv.Field(i).Set(value.Elem())
+  }
+  return skipped, nil
+}
+
+// Filter is a blocklist or allowlist from the AdGuard Home filtering status API
+type Filter struct {
+  ID          int64  `json:"id"`
+  URL         string `json:"url"`
+  Name        string `json:"name"`
+  Enabled     bool   `json:"enabled"`
+  RulesCount  int    `json:"rules_count"`
+  LastUpdated string `json:"last_updated"`
+}
+
+// FilteringStatus represents the response from AdGuard Home filtering status API
+type FilteringStatus struct {
+  Enabled          bool     `json:"enabled"`
+  Interval         int      `json:"interval"` // hours between list updates
+  Filters          []Filter `json:"filters"`
+  WhitelistFilters []Filter `json:"whitelist_filters"`
+}
+
+// Rewrite is a custom DNS answer from the AdGuard Home rewrite API
+type Rewrite struct {
+  Domain string `json:"domain"`
+  Answer string `json:"answer"`
+}
+
+// AccessList represents AdGuard Home's access settings; an empty list leaves that rule unused
+type AccessList struct {
+  AllowedClients    []string `json:"allowed_clients"`    // when set, only these clients may query
+  DisallowedClients []string `json:"disallowed_clients"` // clients whose queries are refused
+  BlockedHosts      []string `json:"blocked_hosts"`      // domains that are never answered
+}
+
+// StatusResponse represents the response from AdGuard Home status API
+type StatusResponse struct {
+  Version           string   `json:"version"`
+  Language          string   `json:"language"`
+  DNSAddresses      []string `json:"dns_addresses"`
+  DNSPort           int      `json:"dns_port"`
+  HTTPPort          int      `json:"http_port"`
+  ProtectionEnabled bool     `json:"protection_enabled"`
+  DHCPAvailable     bool     `json:"dhcp_available"`
+  Running           bool     `json:"running"`
+}
+
+// QueryLogEntry is a single DNS query from the AdGuard Home query log
+type QueryLogEntry struct {
+  Time     string `json:"time"`
+  Client   string `json:"client"`
+  Question struct {
+    Name  string `json:"name"`
+    Type  string `json:"type"`
+    Class string `json:"class"`
+  } `json:"question"`
+  Reason    string `json:"reason"`
+  Status    string `json:"status"`
+  Upstream  string `json:"upstream"`
+  ElapsedMs string `json:"elapsedMs"`
+  ServiceName string `json:"service_name,omitempty"` // set for FilteredBlockedService
+}
+
+// QueryLogResponse represents the response from AdGuard Home query log API
+type QueryLogResponse struct {
+  Data   []QueryLogEntry `json:"data"`
+  Oldest string          `json:"oldest"` // cursor for the next, older page
+}
+
+// UpstreamStat combines the response count and average response time of one upstream
+type UpstreamStat struct {
+  Upstream  string   `json:"upstream"`
+  Count     *int     `json:"count"`       // nil when absent from top_upstreams_responses
+  AvgTimeMs *float64 `json:"avg_time_ms"` // nil when absent from top_upstreams_avg_time
+}
+
+// ClientStats is the activity of one client, counted from its most recent query log entries
+type ClientStats struct {
+  Sampled    int              // query log entries of the client that were counted
+  Blocked    int              // of those, how many were blocked
+  TopDomains []map[string]int // queried domains, most queried first, in the shape of the stats top lists
+}
+
+// StatsSummary is the headline stats pushed to live overview clients
+type StatsSummary struct {
+  Queries         int       `json:"queries"`
+  Blocked         int       `json:"blocked"`
+  BlockedPercent  float64   `json:"blocked_percent"`
+  AvgProcessingMs float64   `json:"avg_processing_ms"`
+  UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Section describes a dashboard section, shared by the navigation, home page cards, page titles
+// and link preview metadata so they stay consistent
+type Section struct {
+  Path        string
+  Label       string // short name used in the navigation and on the home page cards
+  Title       string // page heading and <title>
+  Icon        string
+  Description string
+}
+
+// sections lists the dashboard sections in navigation order
+var sections = []Section{
+  {"/", "Home", "", "🏠", "Overview of DNS queries, blocking and clients from AdGuard Home"},
+  {"/clients", "Clients", "DNS Clients", "📱", "View connected DNS clients and their information"},
+  {"/stats", "Statistics", "DNS Statistics", "📊", "DNS query statistics and blocked domains"},
+  {"/querylog", "Query Log", "Query Log", "🔎", "Recent DNS queries and what was blocked"},
+  {"/upstreams", "Upstreams", "DNS Upstreams", "🌐", "DNS upstream performance and response times"},
+  {"/rewrites", "Rewrites", "DNS Rewrites", "🔀", "Custom DNS answers configured in AdGuard Home"},
+  {"/access", "Access", "Access Control", "🚫", "Allowed and disallowed clients and blocked hosts in AdGuard Home"},
+  {"/filtering", "Filtering", "Filtering", "🛡️", "Blocklists and allowlists configured in AdGuard Home"},
+  {"/status", "Status", "AdGuard Home Status", "🩺", "AdGuard Home version, protection and DHCP state"},
+}
+
+// sectionFor returns the section registered for path
+func sectionFor(path string) Section {
+  for _, section := range sections {
+    if section.Path == path {
+      return section
+    }
+  }
+  return Section{Path: path}
+}
+
+// Summary is the compact /api/summary contract for uptime monitors
+type Summary struct {
+  StatsSummary
+  Clients    int  `json:"clients"`
+  UpstreamOK bool `json:"upstream_ok"` // whether AdGuard Home answered
+}
+
+// Limits for the ?top= query parameter on the stats and upstreams pages
+const (
+  defaultTopN = 10
+  maxTopN     = 100
+)
+
+// Limits for the ?per_page= query parameter on the clients page
+const (
+  defaultPerPage = 50
+  maxPerPage     = 500
+)
+
+// Pagination describes the visible window of a paginated table
+type Pagination struct {
+  Page       int
+  PerPage    int
+  TotalPages int
+  Total      int
+  Start      int // index of the first item on the page
+  End        int // index one past the last item on the page
+}
+
+// Template represents the template structure
+type Template struct {
+  templates *template.Template
+}
+
+// Render implements the echo.Renderer interface
+func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+  start := time.Now()
+  err := t.templates.ExecuteTemplate(w, name, data)
+  if c != nil {
+    setServerTiming(c, time.Since(start))
+  }
+  return err
+}
+
+// robotsTxt returns /robots.txt: every crawler is kept out unless server.allow_indexing is set
+func robotsTxt(config *Config) string {
+  if config.Server.AllowIndexing {
+    return "User-agent: *\nDisallow:\n"
+  }
+  return "User-agent: *\nDisallow: /\n"
+}
+
+// noIndexMiddleware marks HTML responses with X-Robots-Tag: noindex unless server.allow_indexing
+// is set, for crawlers that reach a page without reading robots.txt first. Under server.base_path
+// robots.txt is never read, so pages also carry a robots meta tag in case a proxy drops the header.
+func noIndexMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+  return func(c echo.Context) error {
+    res := c.Response()
+    res.Before(func() {
+      if !currentConfig().Server.AllowIndexing && strings.HasPrefix(res.Header().Get(echo.HeaderContentType), echo.MIMETextHTML) {
+        res.Header().Set("X-Robots-Tag", "noindex")
+      }
+    })
+    return next(c)
+  }
+}
+
+// fetchTimeKey is the echo context key of the time a page spent waiting for AdGuard Home
+const fetchTimeKey = "fetchTime"
+
+// timeFetch starts timing an AdGuard Home fetch for the Server-Timing header of
+// server.debug_timings; the returned function stops it. Handlers time their fetches themselves so
+// that parsing, sorting and other work before rendering isn't reported as fetching.
+func timeFetch(c echo.Context) func() {
+  start := time.Now()
+  return func() {
+    total, _ := c.Get(fetchTimeKey).(time.Duration)
+    c.Set(fetchTimeKey, total+time.Since(start))
+  }
+}
+
+// setServerTiming sets the Server-Timing header (https://www.w3.org/TR/server-timing/) when
+// server.debug_timings is on: the fetches timed by timeFetch, if any, and the template render.
+// Pages are rendered before anything is written, so the header can still be set.
+func setServerTiming(c echo.Context, render time.Duration) {
+  if !currentConfig().Server.DebugTimings {
+    return
+  }
+  milliseconds := func(d time.Duration) string {
+    return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 1, 64)
+  }
+
+  var metrics []string
+  if fetch, ok := c.Get(fetchTimeKey).(time.Duration); ok {
+    metrics = append(metrics, `fetch;desc="AdGuard Home fetch";dur=`+milliseconds(fetch))
+  }
+  metrics = append(metrics, `render;desc="Template render";dur=`+milliseconds(render))
+  c.Response().Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
+
+// includeList is the include: directive, one path or a list of paths
+type includeList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler, accepting a single path as well as a list
+func (l *includeList) UnmarshalYAML(value *yaml.Node) error {
+  if value.Kind == yaml.ScalarNode {
+    *l = includeList{value.Value}
+    return nil
+  }
+  return value.Decode((*[]string)(l))
+}
+
+// loadConfigFile loads the configuration from the file at path, or from stdin when path is "-"
+func loadConfigFile(path string) (*Config, error) {
+  if path == "-" {
+    return parseConfig(os.Stdin)
+  }
+
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  return parseConfigFrom(file, path)
+}
+
+// parseConfig decodes and validates a YAML configuration read from r. Included files are
+// relative to the working directory.
+func parseConfig(r io.Reader) (*Config, error) {
+  return parseConfigFrom(r, "")
+}
+
+// parseConfigFrom is parseConfig for the configuration file at path, which included files are relative to
+func parseConfigFrom(r io.Reader, path string) (*Config, error) {
+  var chain []string
+  if path != "" {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+      return nil, err
+    }
+    chain = []string{abs}
+  }
+
+  var config Config
+  if err := decodeConfig(&config, r, path, chain); err != nil {
+    if errors.Is(err, io.EOF) {
+      return nil, errors.New("the configuration is empty")
+    }
+    return nil, err
+  }
+
+  if err := validateConfig(&config); err != nil {
+    return nil, err
+  }
+
+  return &config, nil
+}
+
+// decodeConfig decodes the YAML read from r, the file at path ("" for stdin), into config, then
+// the files its include: directive names, in order. Each file only sets the keys it contains, so
+// later files override earlier ones key by key. chain holds the files being included, to report
+// include cycles.
+func decodeConfig(config *Config, r io.Reader, path string, chain []string) error {
+  config.Include = nil
+  if err := yaml.NewDecoder(r).Decode(config); err != nil {
+    if path != "" {
+      return fmt.Errorf("%s: %w", path, err)
+    }
+    return err
+  }
+
+  includes := config.Include
+  config.Include = nil
+  for _, include := range includes {
+    if !filepath.IsAbs(include) {
+      include = filepath.Join(filepath.Dir(path), include)
+    }
+    abs, err := filepath.Abs(include)
+    if err != nil {
+      return err
+    }
+    if slices.Contains(chain, abs) {
+      return fmt.Errorf("include cycle: %s", strings.Join(append(chain, abs), " -> "))
+    }
+
+    file, err := os.Open(include)
+    if err != nil {
+      from := path
+      if from == "" {
+        from = "stdin"
+      }
+      return fmt.Errorf("%s: include: %w", from, err)
+    }
+    err = decodeConfig(config, file, include, append(chain, abs))
+    file.Close()
+    // An empty included file sets nothing
+    if err != nil && !errors.Is(err, io.EOF) {
+      return err
+    }
+  }
+  return nil
+}
+
+// activeConfig holds the configuration in use; it is replaced atomically when the configuration is reloaded
+var activeConfig atomic.Pointer[Config]
+
+// currentConfig returns the configuration in use
+func currentConfig() *Config {
+  return activeConfig.Load()
+}
+
+// reloadConfig re-reads the configuration file at path and swaps it in if it is valid, leaving
+// the current configuration in place on error. Settings that shape the listener and middleware
+// chain are kept from the running configuration.
+func reloadConfig(logger echo.Logger, path string) error {
+  if path == "-" {
+    return errors.New("the configuration was read from stdin and cannot be reloaded")
+  }
+
+  config, err := loadConfigFile(path)
+  if err != nil {
+    return err
+  }
+
+  old := currentConfig()
+  if !reflect.DeepEqual(old.Server.ReadOnly, config.Server.ReadOnly) ||
+    !reflect.DeepEqual(old.Server.RateLimit, config.Server.RateLimit) ||
+    old.Server.LiveUpdates != config.Server.LiveUpdates ||
+    old.Server.TLS != config.Server.TLS ||
+    old.basePath() != config.basePath() ||
+    !reflect.DeepEqual(old.Server.CORS, config.Server.CORS) ||
+    !slices.Equal(old.Server.TrustedProxies, config.Server.TrustedProxies) ||
+    old.AdGuard.PollInterval != config.AdGuard.PollInterval {
+    logger.Warn("server.read_only, server.rate_limit, server.live_updates, server.tls, server.base_path, server.cors, server.trusted_proxies and adguard.poll_interval changes take effect after a restart")
+  }
+  config.Server.ReadOnly = old.Server.ReadOnly
+  config.Server.RateLimit = old.Server.RateLimit
+  config.Server.LiveUpdates = old.Server.LiveUpdates
+  config.Server.TLS = old.Server.TLS
+  config.Server.BasePath = old.Server.BasePath
+  config.Server.CORS = old.Server.CORS
+  config.Server.TrustedProxies = old.Server.TrustedProxies
+  config.AdGuard.PollInterval = old.AdGuard.PollInterval
+
+  client, err := newHTTPClient(config)
+  if err != nil {
+    return err
+  }
+
+  httpClient.Store(client)
+  activeConfig.Store(config)
+  logger.SetLevel(config.logLevel())
+
+  // Cached responses may come from a different server or credentials
+  cache.clear()
+
+  // The server may have been upgraded or replaced since startup
+  if err := checkConnectivity(config); err != nil {
+    logger.Warn("Could not detect the AdGuard Home version: ", err)
+  } else {
+    logger.Info("Detected AdGuard Home ", detectedVersion())
+  }
+  return nil
+}
+
+// parseTrustedProxies parses server.trusted_proxies entries, single IPs or CIDR ranges
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+  var ranges []*net.IPNet
+  for _, proxy := range proxies {
+    prefix, err := netip.ParsePrefix(proxy)
+    if err != nil {
+      addr, addrErr := netip.ParseAddr(proxy)
+      if addrErr != nil {
+        return nil, fmt.Errorf("server.trusted_proxies: %q is not an IP address or CIDR range", proxy)
+      }
+      prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+    }
+    _, ipNet, _ := net.ParseCIDR(prefix.Masked().String())
+    ranges = append(ranges, ipNet)
+  }
+  return ranges, nil
+}
+
+// newIPExtractor returns how the client IP is determined for rate limiting and logging: the
+// connection's address, or the X-Forwarded-For address added by one of the trusted proxies
+func newIPExtractor(proxies []*net.IPNet) echo.IPExtractor {
+  if len(proxies) == 0 {
+    return echo.ExtractIPDirect()
+  }
+
+  // Only the configured proxies are trusted, not Echo's default private and loopback ranges
+  options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+  for _, proxy := range proxies {
+    options = append(options, echo.TrustIPRange(proxy))
+  }
+  return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// watchReload reloads the configuration file at path whenever the process receives SIGHUP
+func watchReload(logger echo.Logger, path string) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGHUP)
+
+  for range signals {
+    if err := reloadConfig(logger, path); err != nil {
+      logger.Error("Config reload failed, keeping the current configuration: ", err)
+      continue
+    }
+    logger.Info("Configuration reloaded from ", path)
+  }
+}
+
+// validateConfig checks the loaded configuration for mistakes that would only surface at runtime
+func validateConfig(config *Config) error {
+  if strings.Contains(config.AdGuard.Username, ":") {
+    return errors.New("adguard.username must not contain a colon (HTTP basic auth cannot represent it)")
+  }
+  if strings.HasPrefix(config.AdGuard.ServerURL, unixSocketPrefix) && !strings.HasPrefix(config.unixSocket(), "/") {
+    return errors.New("adguard.server_url: a Unix domain socket needs an absolute path, e.g. unix:///run/adguard.sock")
+  }
+  if config.AdGuard.CacheTTL < 0 {
+    return errors.New("adguard.cache_ttl must not be negative")
+  }
+  if config.AdGuard.PollInterval < 0 {
+    return errors.New("adguard.poll_interval must not be negative")
+  }
+  if config.AdGuard.MaxResponseBytes < 0 {
+    return errors.New("adguard.max_response_bytes must not be negative")
+  }
+  if err := validateHeaders(config.AdGuard.Headers); err != nil {
+    return err
+  }
+  if err := validateTokenAuth(config); err != nil {
+    return err
+  }
+  if config.Display.MaxRows < 0 {
+    return errors.New("display.max_rows must not be negative")
+  }
+  if config.Display.BlockedClientsSample < 0 {
+    return errors.New("display.blocked_clients_sample must not be negative")
+  }
+  if config.Display.StatsMismatchThreshold < 0 {
+    return errors.New("display.stats_mismatch_threshold must not be negative")
+  }
+  for i, bound := range config.Display.LatencyBuckets {
+    if bound <= 0 || i > 0 && bound <= config.Display.LatencyBuckets[i-1] {
+      return errors.New("display.latency_buckets must be positive and in ascending order")
+    }
+  }
+  if !slices.Contains(themes, config.theme()) {
+    return fmt.Errorf("server.theme must be one of %s, got %q", strings.Join(themes, ", "), config.Server.Theme)
+  }
+  if config.AdGuard.MaxConcurrentFetches < 0 {
+    return errors.New("adguard.max_concurrent_fetches must not be negative")
+  }
+  if t := config.AdGuard.Transport; t.MaxIdleConns < 0 || t.MaxIdleConnsPerHost < 0 || t.IdleConnTimeout < 0 {
+    return errors.New("adguard.transport values must not be negative")
+  }
+  if config.AdGuard.Timeout < 0 {
+    return errors.New("adguard.timeout must not be negative")
+  }
+  if config.AdGuard.CircuitBreaker.Failures < 0 || config.AdGuard.CircuitBreaker.Cooldown < 0 {
+    return errors.New("adguard.circuit_breaker failures and cooldown must not be negative")
+  }
+  if config.rateLimit() < 0 {
+    return errors.New("server.rate_limit must not be negative")
+  }
+
+  if config.Server.LiveUpdates.Interval < 0 || config.Server.LiveUpdates.MaxConnections < 0 {
+    return errors.New("server.live_updates values must not be negative")
+  }
+  if config.Server.LiveUpdates.MaxConnections == 0 {
+    config.Server.LiveUpdates.MaxConnections = 20
+  }
+
+  for _, pattern := range append(append([]string{}, config.Display.HideClients...), config.Display.OnlyClients...) {
+    if _, err := path.Match(pattern, ""); err != nil {
+      return fmt.Errorf("display: invalid client pattern %q: %w", pattern, err)
+    }
+  }
+
+  for _, ip := range config.Display.PinnedClients {
+    if _, err := netip.ParseAddr(ip); err != nil {
+      return fmt.Errorf("display.pinned_clients: %q is not an IP address", ip)
+    }
+  }
+
+  seen := make(map[string]bool)
+  for _, column := range config.Display.ClientColumns {
+    if _, ok := clientColumnHeaders[column]; !ok {
+      return fmt.Errorf("display.client_columns: unknown column %q", column)
+    }
+    if seen[column] {
+      return fmt.Errorf("display.client_columns: column %q is listed twice", column)
+    }
+    seen[column] = true
+  }
+
+  config.sourceLabels = maps.Clone(defaultSourceLabels)
+  for source, label := range config.Display.SourceLabels {
+    if strings.TrimSpace(label) == "" {
+      return fmt.Errorf("display.source_labels: label for %q must not be empty", source)
+    }
+    config.sourceLabels[strings.ToLower(source)] = label
+  }
+
+  config.printer = message.NewPrinter(language.AmericanEnglish)
+  if config.Display.Locale != "" {
+    tag, err := language.Parse(config.Display.Locale)
+    if err != nil {
+      return fmt.Errorf("display.locale: %q is not a known locale: %v", config.Display.Locale, err)
+    }
+    config.printer = message.NewPrinter(tag)
+  }
+
+  config.location = time.UTC
+  if config.Server.Timezone != "" {
+    location, err := time.LoadLocation(config.Server.Timezone)
+    if err != nil {
+      return fmt.Errorf("server.timezone: unknown time zone %q", config.Server.Timezone)
+    }
+    config.location = location
+  }
+
+  for _, origin := range config.Server.CORS.AllowedOrigins {
+    if origin == "*" {
+      continue
+    }
+    if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+      return fmt.Errorf("server.cors.allowed_origins: %q must be \"*\" or an origin like https://example.com", origin)
+    }
+  }
+
+  for _, link := range config.Server.Links {
+    if strings.TrimSpace(link.Label) == "" {
+      return fmt.Errorf("server.links: %q needs a label", link.URL)
+    }
+    u, err := url.Parse(link.URL)
+    if err != nil || !((u.Scheme == "http" || u.Scheme == "https") && u.Host != "" || u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")) {
+      return fmt.Errorf("server.links: %q must be an http(s) URL or an absolute path", link.URL)
+    }
+  }
+
+  if _, err := parseTrustedProxies(config.Server.TrustedProxies); err != nil {
+    return err
+  }
+
+  if strings.ContainsAny(config.Server.BasePath, "?#") {
+    return fmt.Errorf("server.base_path: %q must be a plain path", config.Server.BasePath)
+  }
+
+  if config.Server.LogLevel != "" {
+    if _, ok := logLevels[strings.ToLower(config.Server.LogLevel)]; !ok {
+      return fmt.Errorf("server.log_level: unknown level %q", config.Server.LogLevel)
+    }
+  }
+
+  tlsConfig := config.Server.TLS
+  if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+    return errors.New("server.tls.cert_file and server.tls.key_file must be set together")
+  }
+  if tlsConfig.CertFile != "" {
+    if tlsConfig.AutoDomain != "" {
+      return errors.New("server.tls.auto_domain cannot be combined with cert_file/key_file")
+    }
+    for _, path := range []string{tlsConfig.CertFile, tlsConfig.KeyFile} {
+      if _, err := os.ReadFile(path); err != nil {
+        return fmt.Errorf("server.tls: %w", err)
+      }
+    }
+    if _, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile); err != nil {
+      return fmt.Errorf("server.tls: invalid certificate/key pair: %w", err)
+    }
+  }
+
+  return nil
+}
+
+// httpClient holds the shared client used for all AdGuard Home API requests. It is built once
+// by newHTTPClient and replaced on reload; tests can Store a client with a stub transport.
+var httpClient atomic.Pointer[http.Client]
+
+// doAdGuard sends req with the shared AdGuard Home client. While the circuit breaker is open it
+// fails fast with a *circuitOpenError instead of waiting for an unreachable server.
+func doAdGuard(req *http.Request) (*http.Response, error) {
+  config := currentConfig()
+  if err := breaker.allow(config.breakerCooldown()); err != nil {
+    return nil, err
+  }
+
+  resp, err := httpClient.Load().Do(req)
+  switch {
+  case errors.Is(err, context.Canceled):
+    // The caller gave up (e.g. the browser navigated away), which says nothing about AdGuard Home.
+    // A timeout does count: a hung AdGuard Home must open the circuit.
+    breaker.release()
+  case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+    breaker.failure(config.breakerFailures())
+  default:
+    breaker.success()
+  }
+  if err == nil {
+    decodeBody(resp)
+  }
+  return resp, err
+}
+
+// decodeBody makes resp.Body decompress a gzip or deflate Content-Encoding. Go's transport only
+// does this itself when it added Accept-Encoding, and newAdGuardRequest sets that header.
+func decodeBody(resp *http.Response) {
+  encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+  if encoding != "gzip" && encoding != "deflate" {
+    return
+  }
+
+  resp.Body = &decodedBody{raw: resp.Body, encoding: encoding}
+  resp.Header.Del("Content-Encoding")
+  resp.Header.Del("Content-Length")
+  resp.ContentLength = -1
+  resp.Uncompressed = true
+}
+
+// decodedBody decompresses a response body. The decompressor is created on the first Read, so an
+// empty body does not fail before anything reads it.
+type decodedBody struct {
+  raw      io.ReadCloser
+  encoding string
+  reader   io.Reader
+}
+
+// Read implements io.Reader
+func (b *decodedBody) Read(p []byte) (int, error) {
+  if b.reader == nil {
+    var err error
+    if b.encoding == "gzip" {
+      b.reader, err = gzip.NewReader(b.raw)
+    } else {
+      b.reader, err = zlib.NewReader(b.raw)
+    }
+    if err != nil {
+      b.reader = nil
+      return 0, fmt.Errorf("decoding %s response: %w", b.encoding, err)
+    }
+  }
+  return b.reader.Read(p)
+}
+
+// Close implements io.Closer
+func (b *decodedBody) Close() error {
+  return b.raw.Close()
+}
+
+// Circuit breaker states reported on /healthz
+const (
+  breakerClosed   = "closed"
+  breakerOpen     = "open"
+  breakerHalfOpen = "half-open"
+)
+
+// circuitOpenError is returned while the circuit breaker fails fast
+type circuitOpenError struct {
+  retryIn time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+  return fmt.Sprintf("AdGuard Home unreachable, retrying in %ds", int(math.Ceil(e.retryIn.Seconds())))
+}
+
+// circuitBreaker stops sending requests to AdGuard Home after consecutive failures. Once the
+// cooldown has passed it lets a single trial request through (half-open); its outcome closes
+// or reopens the circuit.
+type circuitBreaker struct {
+  mu       sync.Mutex
+  state    string
+  failures int
+  openedAt time.Time
+  probing  bool
+}
+
+// breaker guards every request sent by doAdGuard
+var breaker = &circuitBreaker{state: breakerClosed}
+
+// allow reports whether a request may be sent, or a *circuitOpenError when it must fail fast
+func (b *circuitBreaker) allow(cooldown time.Duration) error {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  if b.state == breakerOpen {
+    if wait := cooldown - time.Since(b.openedAt); wait > 0 {
+      return &circuitOpenError{retryIn: wait}
+    }
+    b.state = breakerHalfOpen
+  }
+  if b.state == breakerHalfOpen {
+    if b.probing {
+      return &circuitOpenError{retryIn: time.Second}
+    }
+    b.probing = true
+  }
+  return nil
+}
+
+// success closes the circuit
+func (b *circuitBreaker) success() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.state = breakerClosed
+  b.failures = 0
+  b.probing = false
+}
+
+// failure counts a failed request and opens the circuit after threshold consecutive failures or
+// a failed half-open trial
+func (b *circuitBreaker) failure(threshold int) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.failures++
+  b.probing = false
+  if b.state == breakerHalfOpen || b.failures >= threshold {
+    b.state = breakerOpen
+    b.openedAt = time.Now()
+  }
+}
+
+// release ends a half-open trial without an outcome so the next request can retry
+func (b *circuitBreaker) release() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.probing = false
+}
+
+// BreakerStatus is the circuit breaker state reported on /healthz
+type BreakerStatus struct {
+  State    string `json:"state"`
+  Failures int    `json:"consecutive_failures"`
+  RetryIn  int    `json:"retry_in_seconds,omitempty"`
+}
+
+// status returns the current breaker state
+func (b *circuitBreaker) status(cooldown time.Duration) BreakerStatus {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  status := BreakerStatus{State: b.state, Failures: b.failures}
+  if b.state == breakerOpen {
+    if wait := cooldown - time.Since(b.openedAt); wait > 0 {
+      status.RetryIn = int(math.Ceil(wait.Seconds()))
+    } else {
+      status.State = breakerHalfOpen
+    }
+  }
+  return status
+}
+
+// newHTTPClient builds the AdGuard Home API client from the configuration
+func newHTTPClient(config *Config) (*http.Client, error) {
+  tlsConfig := &tls.Config{
+    InsecureSkipVerify: config.AdGuard.InsecureSkipVerify,
+  }
+
+  // A pinned CA takes precedence over skipping verification
+  if config.AdGuard.CACertFile != "" {
+    pool, err := loadCACertPool(config.AdGuard.CACertFile)
+    if err != nil {
+      return nil, err
+    }
+    tlsConfig.RootCAs = pool
+    tlsConfig.InsecureSkipVerify = false
+  }
+
+  // Keep connections alive between polls and page loads; a custom TLS config turns off HTTP/2
+  // unless it is forced back on, so HTTPS upstreams that offer it negotiate h2
+  transport := http.DefaultTransport.(*http.Transport).Clone()
+  transport.TLSClientConfig = tlsConfig
+  transport.ForceAttemptHTTP2 = true
+  transport.MaxIdleConns = config.maxIdleConns()
+  transport.MaxIdleConnsPerHost = config.maxIdleConnsPerHost()
+  transport.IdleConnTimeout = config.idleConnTimeout()
+
+  // Every connection goes to the socket, whatever the placeholder host; proxies don't apply
+  if socket := config.unixSocket(); socket != "" {
+    transport.Proxy = nil
+    transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+      var dialer net.Dialer
+      return dialer.DialContext(ctx, "unix", socket)
+    }
+  }
+
+  if limit := config.AdGuard.MaxConcurrentFetches; limit > 0 {
+    return &http.Client{Transport: &limitedTransport{base: transport, slots: semaphore.NewWeighted(int64(limit))}, Timeout: config.timeout()}, nil
+  }
+  return &http.Client{Transport: transport, Timeout: config.timeout()}, nil
+}
+
+// limitedTransport lets at most as many requests through at once as slots has room for, so
+// concurrent page loads, fan-out fetches and the background poller can't overwhelm a small
+// AdGuard Home host. Waiting requests give up when their context is done.
+type limitedTransport struct {
+  base  http.RoundTripper
+  slots *semaphore.Weighted
+}
+
+// RoundTrip implements http.RoundTripper, holding a slot until the response body is closed, as
+// AdGuard Home is still sending until then
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+  if err := t.slots.Acquire(req.Context(), 1); err != nil {
+    return nil, err
+  }
+
+  resp, err := t.base.RoundTrip(req)
+  if err != nil {
+    t.slots.Release(1)
+    return nil, err
+  }
+  resp.Body = &slotBody{ReadCloser: resp.Body, release: func() { t.slots.Release(1) }}
+  return resp, nil
+}
+
+// slotBody is a response body that gives its limitedTransport slot back when closed
+type slotBody struct {
+  io.ReadCloser
+  release func()
+  once    sync.Once
+}
+
+// Close implements io.Closer, releasing the slot only once however often it is called
+func (b *slotBody) Close() error {
+  err := b.ReadCloser.Close()
+  b.once.Do(b.release)
+  return err
+}
+
+// loadCACertPool reads PEM encoded CA certificates into a new certificate pool
+func loadCACertPool(path string) (*x509.CertPool, error) {
+  pem, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("adguard.ca_cert_file: %w", err)
+  }
+
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(pem) {
+    return nil, fmt.Errorf("adguard.ca_cert_file: no PEM certificates found in %s", path)
+  }
+
+  return pool, nil
+}
+
+// getBasicAuth returns the base64 encoded basic auth string. The credentials are split at the
+// first colon (RFC 7617), so the password may contain colons but the username must not;
+// validateConfig rejects such usernames.
+func getBasicAuth(username, password string) string {
+  auth := username + ":" + password
+  return base64.StdEncoding.EncodeToString([]byte(auth))
+}
+
+// reservedHeaders are set by Aghamon or the HTTP client itself and cannot be set in adguard.headers
+var reservedHeaders = []string{"Authorization", "Connection", "Content-Length", "Content-Type", "Transfer-Encoding", "Upgrade"}
+
+// validateHeaders checks the adguard.headers names and values
+func validateHeaders(headers map[string]string) error {
+  for name, value := range headers {
+    if name == "" || strings.IndexFunc(name, func(r rune) bool {
+      return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+    }) >= 0 {
+      return fmt.Errorf("adguard.headers: invalid header name %q", name)
+    }
+    if slices.ContainsFunc(reservedHeaders, func(reserved string) bool { return strings.EqualFold(reserved, name) }) {
+      return fmt.Errorf("adguard.headers: %s is set by Aghamon and cannot be overridden", name)
+    }
+    if strings.ContainsAny(value, "\r\n\x00") {
+      return fmt.Errorf("adguard.headers: value of %s must not contain line breaks", name)
+    }
+  }
+  return nil
+}
+
+// validateTokenAuth checks adguard.auth and, in token mode, the token and the header it is sent in
+func validateTokenAuth(config *Config) error {
+  switch config.authMode() {
+  case authBasic:
+    return nil
+  case authToken:
+  default:
+    return fmt.Errorf("adguard.auth must be %s or %s, got %q", authBasic, authToken, config.AdGuard.Auth)
+  }
+
+  if config.AdGuard.Token == "" {
+    return errors.New("adguard.token is required with adguard.auth: token")
+  }
+  if strings.ContainsAny(config.AdGuard.Token, "\r\n\x00") {
+    return errors.New("adguard.token must not contain line breaks")
+  }
+
+  // The token header follows the adguard.headers rules, except that it may be Authorization
+  name := config.tokenHeader()
+  if strings.EqualFold(name, "Authorization") {
+    return nil
+  }
+  if err := validateHeaders(map[string]string{name: ""}); err != nil {
+    return fmt.Errorf("adguard.token_header: %q is not a header Aghamon can send the token in", name)
+  }
+  for header := range config.AdGuard.Headers {
+    if strings.EqualFold(header, name) {
+      return fmt.Errorf("adguard.token_header: %s is also set in adguard.headers", name)
+    }
+  }
+  return nil
+}
+
+// newAdGuardRequest builds an authenticated request for an AdGuard Home API path, relative to
+// adguard.api_base_path (e.g. "/stats" for /control/stats)
+func newAdGuardRequest(ctx context.Context, config *Config, method, path string, body io.Reader) (*http.Request, error) {
+  req, err := http.NewRequestWithContext(ctx, method, config.serverURL()+config.apiBasePath()+path, body)
+  if err != nil {
+    return nil, err
+  }
+
+  // A proxy in front of AdGuard Home may expect a static token instead of basic auth. AdGuard Home
+  // itself may run without authentication; don't send empty credentials ("Basic Og==") then.
+  if config.authMode() == authToken {
+    req.Header.Set(config.tokenHeader(), config.tokenValue())
+  } else if config.AdGuard.Username != "" || config.AdGuard.Password != "" {
+    req.Header.Set("Authorization", "Basic "+getBasicAuth(config.AdGuard.Username, config.AdGuard.Password))
+  }
+  req.Header.Set("Accept", "application/json")
+  req.Header.Set("Accept-Encoding", "gzip, deflate")
+  req.Header.Set("Referer", config.serverURL()+"/")
+  req.Header.Set("User-Agent", "aghamon/"+version)
+
+  // Extra headers for proxies in front of AdGuard Home; Go sends Host from req.Host, not the header map
+  for name, value := range config.AdGuard.Headers {
+    if strings.EqualFold(name, "Host") {
+      req.Host = value
+      continue
+    }
+    req.Header.Set(name, value)
+  }
+
+  return req, nil
+}
+
+// checkConnectivity makes a single request to AdGuard Home's status endpoint to verify the URL and
+// credentials, and records the AdGuard Home version it reports (see detectedVersion)
+func checkConnectivity(config *Config) error {
+  // A configured version wins; it stays in effect even when AdGuard Home can't be reached
+  if config.AdGuard.Version != "" {
+    storeVersion(parseAdGuardVersion(config.AdGuard.Version))
+  } else {
+    storeVersion(AdGuardVersion{})
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  req, err := newAdGuardRequest(ctx, config, http.MethodGet, "/status", nil)
+  if err != nil {
+    return err
+  }
+
+  resp, err := doAdGuard(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+  }
+
+  var status StatusResponse
+  if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+    return fmt.Errorf("%s: %w", req.URL, err)
+  }
+  if config.AdGuard.Version == "" {
+    storeVersion(parseAdGuardVersion(status.Version))
+  }
+  return nil
+}
+
+// AdGuardVersion is the AdGuard Home version found at startup or reload, e.g. v0.107.52. Behavior
+// that differs between versions only changes for a known version; an unknown one is treated as
+// recent, with fallbacks where an older API may be needed.
+type AdGuardVersion struct {
+  Raw   string
+  Known bool
+  parts [3]int
+}
+
+// adguardVersionPattern matches the numeric part of versions such as v0.107.52 or v0.108.0-b.3
+var adguardVersionPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+
+// parseAdGuardVersion parses a reported version; development builds ("edge") are not Known
+func parseAdGuardVersion(raw string) AdGuardVersion {
+  version := AdGuardVersion{Raw: raw}
+  match := adguardVersionPattern.FindStringSubmatch(strings.TrimSpace(raw))
+  if match == nil {
+    return version
+  }
+  for i := range version.parts {
+    version.parts[i], _ = strconv.Atoi(match[i+1])
+  }
+  version.Known = true
+  return version
+}
+
+// olderThan reports whether the version is known to be older than major.minor.patch
+func (v AdGuardVersion) olderThan(major, minor, patch int) bool {
+  return v.Known && slices.Compare(v.parts[:], []int{major, minor, patch}) < 0
+}
+
+// String returns the version as reported, or "unknown"
+func (v AdGuardVersion) String() string {
+  if v.Raw == "" {
+    return "unknown"
+  }
+  return v.Raw
+}
+
+// adguardVersion holds the detected AdGuard Home version
+var adguardVersion atomic.Pointer[AdGuardVersion]
+
+// storeVersion records the AdGuard Home version
+func storeVersion(version AdGuardVersion) {
+  adguardVersion.Store(&version)
+}
+
+// detectedVersion returns the AdGuard Home version found at startup or the last reload
+func detectedVersion() AdGuardVersion {
+  if version := adguardVersion.Load(); version != nil {
+    return *version
+  }
+  return AdGuardVersion{}
+}
+
+// fetchJSON fetches an AdGuard Home API path and decodes the JSON response into v
+func fetchJSON(ctx context.Context, config *Config, path string, v interface{}) error {
+  body, err := openAdGuard(ctx, config, path)
+  if err != nil {
+    return err
+  }
+  defer body.Close()
+
+  data, err := io.ReadAll(body)
+  if err != nil {
+    return err
+  }
+
+  // A login page or proxy error page otherwise surfaces as "invalid character '<'"
+  if err := json.Unmarshal(data, v); err != nil {
+    return fmt.Errorf("%s returned %s with a body that is not valid JSON (%v): %q", body.url, body.status, err, bodySnippet(data, 200))
+  }
+  return nil
+}
+
+// bodySnippet returns up to max bytes of a response body for error messages, with control
+// characters and runs of whitespace collapsed to single spaces
+func bodySnippet(data []byte, max int) string {
+  text := strings.Map(func(r rune) rune {
+    if unicode.IsControl(r) {
+      return ' '
+    }
+    return r
+  }, strings.ToValidUTF8(string(data), ""))
+  text = strings.Join(strings.Fields(text), " ")
+
+  if len(text) <= max {
+    return text
+  }
+  // Cut on a rune boundary
+  for max > 0 && !utf8.RuneStart(text[max]) {
+    max--
+  }
+  return text[:max] + "…"
+}
+
+// openAdGuard sends a GET request for an AdGuard Home API path and returns the response body,
+// capped at adguard.max_response_bytes. The caller must close it.
+func openAdGuard(ctx context.Context, config *Config, path string) (*limitedBody, error) {
+  req, err := newAdGuardRequest(ctx, config, http.MethodGet, path, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  resp, err := doAdGuard(req)
+  if err != nil {
+    return nil, err
+  }
+
+  // Error pages (e.g. 401 for wrong credentials) must not be decoded as data
+  if resp.StatusCode != http.StatusOK {
+    defer resp.Body.Close()
+    return nil, statusError(req, resp)
+  }
+
+  return &limitedBody{ReadCloser: resp.Body, url: req.URL.String(), status: resp.Status, limit: config.maxResponseBytes()}, nil
+}
+
+// errResponseTooLarge is returned when an AdGuard Home response exceeds adguard.max_response_bytes
+var errResponseTooLarge = errors.New("response too large")
+
+// limitedBody is a response body that fails with errResponseTooLarge once more than limit bytes are read
+type limitedBody struct {
+  io.ReadCloser
+  url    string
+  status string
+  limit  int64
+  read   int64
+}
+
+// Read implements io.Reader
+func (b *limitedBody) Read(p []byte) (int, error) {
+  // Allow one byte past the limit so a body of exactly limit bytes still reaches EOF
+  if max := b.limit + 1 - b.read; int64(len(p)) > max {
+    p = p[:max]
+  }
+
+  n, err := b.ReadCloser.Read(p)
+  b.read += int64(n)
+  if b.read > b.limit {
+    return 0, fmt.Errorf("%s: %w: more than %d bytes", b.url, errResponseTooLarge, b.limit)
+  }
+  return n, err
+}
+
+// postAdGuard sends a POST request with an optional JSON payload to an AdGuard Home API path and
+// decodes the JSON response into result unless it is nil
+func postAdGuard(ctx context.Context, config *Config, path string, payload, result interface{}) error {
+  var body io.Reader
+  if payload != nil {
+    data, err := json.Marshal(payload)
+    if err != nil {
+      return err
+    }
+    body = bytes.NewReader(data)
+  }
+
+  req, err := newAdGuardRequest(ctx, config, http.MethodPost, path, body)
+  if err != nil {
+    return err
+  }
+  if payload != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+
+  resp, err := doAdGuard(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    return statusError(req, resp)
+  }
+  if result == nil {
+    return nil
+  }
+
+  data, err := io.ReadAll(&limitedBody{ReadCloser: resp.Body, url: req.URL.String(), limit: config.maxResponseBytes()})
+  if err != nil {
+    return err
+  }
+  if err := json.Unmarshal(data, result); err != nil {
+    return fmt.Errorf("%s returned %s with a body that is not valid JSON (%v): %q", req.URL, resp.Status, err, bodySnippet(data, 200))
+  }
+  return nil
+}
+
+// upstreamStatusError is a non-200 AdGuard Home response
+type upstreamStatusError struct {
+  code    int
+  message string
+}
+
+func (e *upstreamStatusError) Error() string {
+  return e.message
+}
+
+// statusError describes a non-200 AdGuard Home response, including the start of its body
+func statusError(req *http.Request, resp *http.Response) error {
+  message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+  if text := strings.TrimSpace(string(message)); text != "" {
+    return &upstreamStatusError{code: resp.StatusCode, message: fmt.Sprintf("%s returned %s: %s", req.URL, resp.Status, text)}
+  }
+  return &upstreamStatusError{code: resp.StatusCode, message: fmt.Sprintf("%s returned %s", req.URL, resp.Status)}
+}
+
+// resetStats clears all statistics in AdGuard Home
+func resetStats(ctx context.Context, config *Config) error {
+  return postAdGuard(ctx, config, "/stats_reset", nil, nil)
+}
+
+// searchClients looks up a client by exact identifier (IP, CIDR, MAC or ClientID) with AdGuard Home's
+// client search API, which also finds clients that are not in the clients list. Versions before
+// v0.107.43 only have the older /clients/find; it is also tried when the version is unknown and
+// the search API is missing.
+func searchClients(ctx context.Context, config *Config, id string) ([]Client, error) {
+  payload := map[string]interface{}{
+    "clients": []map[string]string{{"id": id}},
+  }
+
+  // The response of both is a list of single-key objects mapping the searched identifier to the client
+  var results []map[string]Client
+  var err error
+  if detectedVersion().olderThan(0, 107, 43) {
+    err = fetchJSON(ctx, config, "/clients/find?"+url.Values{"ip0": {id}}.Encode(), &results)
+  } else {
+    err = postAdGuard(ctx, config, "/clients/search", payload, &results)
+    var statusErr *upstreamStatusError
+    if !detectedVersion().Known && errors.As(err, &statusErr) &&
+      (statusErr.code == http.StatusNotFound || statusErr.code == http.StatusMethodNotAllowed) {
+      err = fetchJSON(ctx, config, "/clients/find?"+url.Values{"ip0": {id}}.Encode(), &results)
+    }
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var clients []Client
+  for _, result := range results {
+    for key, client := range result {
+      if client.IP == "" {
+        client.IP = key
+      }
+      clients = append(clients, client)
+    }
+  }
+  return clients, nil
+}
+
+// fetchClients fetches client data from AdGuard Home API
+func fetchClients(ctx context.Context, config *Config) (*ClientsResponse, error) {
+  var clientsResponse ClientsResponse
+  if err := fetchJSON(ctx, config, "/clients", &clientsResponse); err != nil {
+    return nil, err
+  }
+
+  return &clientsResponse, nil
+}
+
+// StatsRange is a stats time window chosen with /stats?from=...&to=...
+type StatsRange struct {
+  From time.Time
+  To   time.Time
+}
+
+// fetchStats fetches stats data from AdGuard Home API, for rng when it is not nil. The range is
+// sent as start and end in Unix milliseconds, which only recent AdGuard Home versions understand.
+func fetchStats(ctx context.Context, config *Config, rng *StatsRange) (*StatsResponse, error) {
+  path := "/stats"
+  if rng != nil {
+    params := url.Values{}
+    params.Set("start", strconv.FormatInt(rng.From.UnixMilli(), 10))
+    params.Set("end", strconv.FormatInt(rng.To.UnixMilli(), 10))
+    path += "?" + params.Encode()
+  }
+
+  var statsResponse StatsResponse
+  if err := fetchJSON(ctx, config, path, &statsResponse); err != nil {
+    return nil, err
+  }
+
+  return &statsResponse, nil
+}
+
+// getStatsInRange fetches stats for rng, bypassing the cache. When AdGuard Home rejects the range
+// parameters, or answers with stats that don't cover it, it returns the default window and
+// reports false.
+func getStatsInRange(ctx context.Context, config *Config, rng *StatsRange) (*StatsResponse, time.Time, bool, error) {
+  statsResponse, err := fetchStats(ctx, config, rng)
+  var statusErr *upstreamStatusError
+  if errors.As(err, &statusErr) && rangeUnsupported(statusErr.code) {
+    statsResponse, fetchedAt, err := getStats(ctx, config)
+    return statsResponse, fetchedAt, false, err
+  }
+  if err != nil {
+    return nil, time.Time{}, false, err
+  }
+
+  // Versions that ignore the parameters answer with the default window instead. Without the
+  // default stats to compare against, only the length of the series is checked.
+  defaults, _, err := getStats(ctx, config)
+  if err != nil {
+    defaults = nil
+  }
+  return statsResponse, time.Now(), rangeCovered(statsResponse, defaults, rng), nil
+}
+
+// rangeCovered reports whether stats fetched for rng are for that window: the series has one
+// entry per hour or day of the range (give or take one for partial units at the edges), and for a
+// range ending before the current unit it differs from the default stats.
+func rangeCovered(stats, defaults *StatsResponse, rng *StatsRange) bool {
+  unit := time.Hour
+  if stats.TimeUnits == "days" {
+    unit = 24 * time.Hour
+  }
+  want := int(math.Ceil(float64(rng.To.Sub(rng.From)) / float64(unit)))
+  if got := len(stats.DNSQueries); got < want-1 || got > want+1 {
+    return false
+  }
+
+  // A range ending now is the default window when it has the same length
+  if defaults == nil || rng.To.After(time.Now().Add(-unit)) {
+    return true
+  }
+  return stats.NumDNSQueries != defaults.NumDNSQueries || !slices.Equal(stats.DNSQueries, defaults.DNSQueries)
+}
+
+// rangeUnsupported reports whether a stats response status means the server doesn't know the range parameters
+func rangeUnsupported(code int) bool {
+  switch code {
+  case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusNotImplemented:
+    return true
+  }
+  return false
+}
+
+// fetchStatus fetches the server status from AdGuard Home API
+func fetchStatus(ctx context.Context, config *Config) (*StatusResponse, error) {
+  var statusResponse StatusResponse
+  if err := fetchJSON(ctx, config, "/status", &statusResponse); err != nil {
+    return nil, err
+  }
+
+  return &statusResponse, nil
+}
+
+// statusBadgeMaxAge is the longest the protection badge in the page header reuses a cached status,
+// so it doesn't cost an AdGuard Home request on every page even with caching disabled
+const statusBadgeMaxAge = 30 * time.Second
+
+// getStatus returns the AdGuard Home status, using the cache when it is younger than ttl
+func getStatus(ctx context.Context, config *Config, ttl time.Duration) (*StatusResponse, error) {
+  entry, err := cache.load(ctx, "status", ttl, func(ctx context.Context) (interface{}, error) {
+    return fetchStatus(ctx, config)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return entry.value.(*StatusResponse), nil
+}
+
+// ProtectionBadge is the protection state shown in the page header: "on", "off", or "unknown"
+// when AdGuard Home could not be reached
+type ProtectionBadge struct {
+  State string
+  Label string
+}
+
+// protectionBadge returns the header badge for AdGuard Home's current protection state
+func protectionBadge(c echo.Context, config *Config) ProtectionBadge {
+  stop := timeFetch(c)
+  status, err := getStatus(c.Request().Context(), config, max(config.cacheTTL(), statusBadgeMaxAge))
+  stop()
+  switch {
+  case err != nil:
+    c.Logger().Debug("protection badge: ", err)
+    return ProtectionBadge{State: "unknown", Label: "Protection unknown"}
+  case status.ProtectionEnabled:
+    return ProtectionBadge{State: "on", Label: "Protection on"}
+  default:
+    return ProtectionBadge{State: "off", Label: "Protection off"}
+  }
+}
+
+// fetchFilteringStatus fetches the configured blocklists and allowlists from AdGuard Home API
+func fetchFilteringStatus(ctx context.Context, config *Config) (*FilteringStatus, error) {
+  var filteringStatus FilteringStatus
+  if err := fetchJSON(ctx, config, "/filtering/status", &filteringStatus); err != nil {
+    return nil, err
+  }
+
+  return &filteringStatus, nil
+}
+
+// setFilterEnabled enables or disables a blocklist (or allowlist when whitelist is set) by URL.
+// AdGuard Home replaces the whole list entry, so the name is sent back unchanged.
+func setFilterEnabled(ctx context.Context, config *Config, filter Filter, whitelist, enabled bool) error {
+  payload := map[string]interface{}{
+    "url":       filter.URL,
+    "whitelist": whitelist,
+    "data": map[string]interface{}{
+      "name":    filter.Name,
+      "url":     filter.URL,
+      "enabled": enabled,
+    },
+  }
+  return postAdGuard(ctx, config, "/filtering/set_url", payload, nil)
+}
+
+// refreshFilters makes AdGuard Home download its blocklists (or allowlists when whitelist is set)
+// again and returns how many of them changed
+func refreshFilters(ctx context.Context, config *Config, whitelist bool) (int, error) {
+  var result struct {
+    Updated int `json:"updated"`
+  }
+  if err := postAdGuard(ctx, config, "/filtering/refresh", map[string]bool{"whitelist": whitelist}, &result); err != nil {
+    return 0, err
+  }
+  return result.Updated, nil
+}
+
+// totalRules returns the number of rules in the enabled lists
+func totalRules(filters []Filter) int {
+  total := 0
+  for _, filter := range filters {
+    if filter.Enabled {
+      total += filter.RulesCount
+    }
+  }
+  return total
+}
+
+// fetchRewrites fetches the DNS rewrites from AdGuard Home API
+func fetchRewrites(ctx context.Context, config *Config) ([]Rewrite, error) {
+  var rewrites []Rewrite
+  if err := fetchJSON(ctx, config, "/rewrite/list", &rewrites); err != nil {
+    return nil, err
+  }
+
+  return rewrites, nil
+}
+
+// addRewrite adds a DNS rewrite in AdGuard Home
+func addRewrite(ctx context.Context, config *Config, rewrite Rewrite) error {
+  return postAdGuard(ctx, config, "/rewrite/add", rewrite, nil)
+}
+
+// deleteRewrite deletes a DNS rewrite in AdGuard Home; both domain and answer must match
+func deleteRewrite(ctx context.Context, config *Config, rewrite Rewrite) error {
+  return postAdGuard(ctx, config, "/rewrite/delete", rewrite, nil)
+}
+
+// fetchAccessList fetches the access settings from AdGuard Home API
+func fetchAccessList(ctx context.Context, config *Config) (*AccessList, error) {
+  var accessList AccessList
+  if err := fetchJSON(ctx, config, "/access/list", &accessList); err != nil {
+    return nil, err
+  }
+
+  return &accessList, nil
+}
+
+// setAccessList replaces all access settings in AdGuard Home
+func setAccessList(ctx context.Context, config *Config, accessList *AccessList) error {
+  return postAdGuard(ctx, config, "/access/set", accessList, nil)
+}
+
+// fetchQueryLog fetches query log entries from AdGuard Home API, filtered by params
+// (limit, older_than, search, response_status)
+func fetchQueryLog(ctx context.Context, config *Config, params url.Values) (*QueryLogResponse, error) {
+  var queryLogResponse QueryLogResponse
+  if err := fetchJSON(ctx, config, "/querylog?"+params.Encode(), &queryLogResponse); err != nil {
+    return nil, err
+  }
+
+  return &queryLogResponse, nil
+}
+
+// decodeQueryLog decodes a query log response from r one entry at a time, calling fn for each entry
+// as soon as it is parsed, and returns the oldest cursor
+func decodeQueryLog(r io.Reader, fn func(QueryLogEntry) error) (string, error) {
+  dec := json.NewDecoder(r)
+  if err := expectDelim(dec, '{'); err != nil {
+    return "", err
+  }
+
+  var oldest string
+  for dec.More() {
+    token, err := dec.Token()
+    if err != nil {
+      return "", err
+    }
+
+    switch token {
+    case "data":
+      if err := expectDelim(dec, '['); err != nil {
+        return "", err
+      }
+      for dec.More() {
+        var entry QueryLogEntry
+        if err := dec.Decode(&entry); err != nil {
+          return "", err
+        }
+        if err := fn(entry); err != nil {
+          return "", err
+        }
+      }
+      if err := expectDelim(dec, ']'); err != nil {
+        return "", err
+      }
+    case "oldest":
+      if err := dec.Decode(&oldest); err != nil {
+        return "", err
+      }
+    default:
+      var skip json.RawMessage
+      if err := dec.Decode(&skip); err != nil {
+        return "", err
+      }
+    }
+  }
+
+  return oldest, expectDelim(dec, '}')
+}
+
+// expectDelim reads the next JSON token and fails unless it is delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+  token, err := dec.Token()
+  if err != nil {
+    return err
+  }
+  if token != delim {
+    return fmt.Errorf("unexpected JSON token %v, expected %v", token, delim)
+  }
+  return nil
+}
+
+// queryTypeSampleSize is how many recent query log entries the query type breakdown is computed from
+const queryTypeSampleSize = 1000
+
+// getQuerySample returns the most recent query log entries, using the cache when it is fresh.
+// The query type breakdown and the upstream latency histogram are both computed from it.
+func getQuerySample(ctx context.Context, config *Config) (*QueryLogResponse, error) {
+  entry, err := cache.load(ctx, "querysample", config.cacheTTL(), func(ctx context.Context) (interface{}, error) {
+    return fetchQueryLog(ctx, config, url.Values{"limit": {strconv.Itoa(queryTypeSampleSize)}})
+  })
+  if err != nil {
+    return nil, err
+  }
+  return entry.value.(*QueryLogResponse), nil
+}
+
+// getQueryTypes counts query types (A, AAAA, HTTPS, ...) over the most recent query log entries.
+// /control/stats has no per-type counts, so they are sampled.
+func getQueryTypes(ctx context.Context, config *Config) (map[string]int, int, error) {
+  queryLog, err := getQuerySample(ctx, config)
+  if err != nil {
+    return nil, 0, err
+  }
+
+  counts := make(map[string]int)
+  for _, query := range queryLog.Data {
+    if query.Question.Type != "" {
+      counts[query.Question.Type]++
+    }
+  }
+  return counts, len(queryLog.Data), nil
+}
+
+// getBlockedClients counts blocked queries per client over the most recent blocked query log
+// entries, using the cache when it is fresh. The result has the shape of the stats top lists,
+// most blocked first, and the number of entries sampled.
+func getBlockedClients(ctx context.Context, config *Config) ([]map[string]int, int, error) {
+  queryLog, err := getBlockedSample(ctx, config)
+  if err != nil {
+    return nil, 0, err
+  }
+
+  counts := make(map[string]int)
+  for _, query := range queryLog.Data {
+    if isBlockedQuery(query) && query.Client != "" {
+      counts[query.Client]++
+    }
+  }
+  return rankCounts(counts), len(queryLog.Data), nil
+}
+
+// getBlockedSample returns the most recent blocked query log entries (display.blocked_clients_sample),
+// using the cache when it is fresh
+func getBlockedSample(ctx context.Context, config *Config) (*QueryLogResponse, error) {
+  entry, err := cache.load(ctx, "blockedclients", config.cacheTTL(), func(ctx context.Context) (interface{}, error) {
+    return fetchQueryLog(ctx, config, url.Values{
+      "limit":           {strconv.Itoa(config.blockedClientsSample())},
+      "response_status": {"blocked"},
+    })
+  })
+  if err != nil {
+    return nil, err
+  }
+  return entry.value.(*QueryLogResponse), nil
+}
+
+// blockedCategoryLabels names the query log block reasons used as blocked domain categories
+var blockedCategoryLabels = map[string]string{
+  "FilteredBlackList":      "Blocklists",
+  "FilteredSafeBrowsing":   "Safe Browsing",
+  "FilteredParental":       "Parental Control",
+  "FilteredBlockedService": "Blocked Services",
+  "FilteredInvalid":        "Invalid Queries",
+}
+
+// blockedCategory returns the category of a blocked query: the blocked service by name, or what
+// blocked it (a blocklist, safe browsing, parental control)
+func blockedCategory(entry QueryLogEntry) string {
+  if entry.Reason == "FilteredBlockedService" && entry.ServiceName != "" {
+    return "Blocked Service: " + entry.ServiceName
+  }
+  if label, ok := blockedCategoryLabels[entry.Reason]; ok {
+    return label
+  }
+  return entry.Reason
+}
+
+// getBlockedCategories maps blocked domains to their category, taken from the recent blocked
+// queries since /control/stats has none; a domain blocked for several reasons gets the most
+// frequent one. The map is empty when the sample has no blocked queries.
+func getBlockedCategories(ctx context.Context, config *Config) (map[string]string, error) {
+  queryLog, err := getBlockedSample(ctx, config)
+  if err != nil {
+    return nil, err
+  }
+
+  counts := make(map[string]map[string]int)
+  for _, query := range queryLog.Data {
+    if !isBlockedQuery(query) || query.Question.Name == "" {
+      continue
+    }
+    if counts[query.Question.Name] == nil {
+      counts[query.Question.Name] = make(map[string]int)
+    }
+    counts[query.Question.Name][blockedCategory(query)]++
+  }
+
+  categories := make(map[string]string, len(counts))
+  for domain, byCategory := range counts {
+    // rankCounts breaks ties by name, so the choice is stable
+    for category := range rankCounts(byCategory)[0] {
+      categories[domain] = category
+    }
+  }
+  return categories, nil
+}
+
+// LatencyHistogram counts the sampled queries answered by one upstream per latency bucket
+type LatencyHistogram struct {
+  Upstream string
+  Counts   []int // one more than there are bucket boundaries
+  Total    int
+}
+
+// upstreamLatencies sorts the upstream answers in queryLog into latency buckets split at bounds
+// (milliseconds, ascending), busiest upstream first. Blocked and cached answers have no upstream
+// or timing and are skipped, so the result is empty when the query log has no timings.
+func upstreamLatencies(queryLog *QueryLogResponse, bounds []float64) []LatencyHistogram {
+  index := make(map[string]int)
+  var histograms []LatencyHistogram
+  for _, query := range queryLog.Data {
+    elapsed, err := strconv.ParseFloat(query.ElapsedMs, 64)
+    if query.Upstream == "" || err != nil {
+      continue
+    }
+
+    i, ok := index[query.Upstream]
+    if !ok {
+      i = len(histograms)
+      index[query.Upstream] = i
+      histograms = append(histograms, LatencyHistogram{Upstream: query.Upstream, Counts: make([]int, len(bounds)+1)})
+    }
+    // The first bucket whose upper bound is above elapsed, or the last one
+    bucket, _ := slices.BinarySearch(bounds, elapsed)
+    if bucket < len(bounds) && bounds[bucket] == elapsed {
+      bucket++
+    }
+    histograms[i].Counts[bucket]++
+    histograms[i].Total++
+  }
+
+  sort.SliceStable(histograms, func(i, j int) bool {
+    return histograms[i].Total > histograms[j].Total
+  })
+  return histograms
+}
+
+// clientStatsSampleSize is how many recent query log entries per-client stats are computed from
+const clientStatsSampleSize = 1000
+
+// getClientStats counts the queries, blocked queries and queried domains of the client with ip
+// over its most recent query log entries, using the cache when it is fresh. /control/stats cannot
+// be scoped to a client, so the query log is searched for the client instead.
+func getClientStats(ctx context.Context, config *Config, ip string) (*ClientStats, error) {
+  if ip == "" {
+    return nil, errors.New("client has no IP address to search the query log for")
+  }
+
+  entry, err := cache.load(ctx, "clientstats:"+ip, config.cacheTTL(), func(ctx context.Context) (interface{}, error) {
+    return fetchQueryLog(ctx, config, url.Values{
+      "limit":  {strconv.Itoa(clientStatsSampleSize)},
+      "search": {ip},
+    })
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  // The search also matches domains containing ip, so only entries from the client itself count
+  stats := &ClientStats{}
+  domains := make(map[string]int)
+  for _, query := range entry.value.(*QueryLogResponse).Data {
+    if displayIP(query.Client) != displayIP(ip) {
+      continue
+    }
+    stats.Sampled++
+    if isBlockedQuery(query) {
+      stats.Blocked++
+    }
+    if query.Question.Name != "" {
+      domains[query.Question.Name]++
+    }
+  }
+  stats.TopDomains = rankCounts(domains)
+  return stats, nil
+}
+
+// rankCounts turns counts into the shape of the stats top lists, highest count first and ties by name
+func rankCounts(counts map[string]int) []map[string]int {
+  names := make([]string, 0, len(counts))
+  for name := range counts {
+    names = append(names, name)
+  }
+  sort.Slice(names, func(i, j int) bool {
+    if counts[names[i]] != counts[names[j]] {
+      return counts[names[i]] > counts[names[j]]
+    }
+    return names[i] < names[j]
+  })
+
+  data := make([]map[string]int, len(names))
+  for i, name := range names {
+    data[i] = map[string]int{name: counts[name]}
+  }
+  return data
+}
+
+// cacheEntry is a cached AdGuard Home response
+type cacheEntry struct {
+  value     interface{}
+  fetchedAt time.Time
+}
+
+// responseCache caches AdGuard Home responses by endpoint
+type responseCache struct {
+  mu      sync.Mutex
+  entries map[string]cacheEntry
+  group   singleflight.Group // collapses concurrent fetches of the same key
+}
+
+// cache is the shared AdGuard Home response cache
+var cache = &responseCache{entries: make(map[string]cacheEntry)}
+
+// get returns the entry for key if it is younger than ttl
+func (rc *responseCache) get(key string, ttl time.Duration) (cacheEntry, bool) {
+  rc.mu.Lock()
+  defer rc.mu.Unlock()
+
+  entry, ok := rc.entries[key]
+  if !ok || time.Since(entry.fetchedAt) >= ttl {
+    return cacheEntry{}, false
+  }
+  return entry, true
+}
+
+// set stores value under key and returns the time it was cached
+func (rc *responseCache) set(key string, value interface{}) time.Time {
+  rc.mu.Lock()
+  defer rc.mu.Unlock()
+
+  now := time.Now()
+  rc.entries[key] = cacheEntry{value: value, fetchedAt: now}
+  return now
+}
+
+// load returns the entry for key if it is younger than ttl, otherwise it calls fetch
+// once for all concurrent callers and caches the result. The fetch is shared, so it runs
+// without ctx's cancellation (adguard.timeout still bounds it); a caller whose ctx is done
+// stops waiting for it.
+func (rc *responseCache) load(ctx context.Context, key string, ttl time.Duration, fetch func(ctx context.Context) (interface{}, error)) (cacheEntry, error) {
+  if entry, ok := rc.get(key, ttl); ok {
+    return entry, nil
+  }
+
+  shared := context.WithoutCancel(ctx)
+  result := rc.group.DoChan(key, func() (interface{}, error) {
+    value, err := fetch(shared)
+    if err != nil {
+      return nil, err
+    }
+    return cacheEntry{value: value, fetchedAt: rc.set(key, value)}, nil
+  })
+
+  select {
+  case <-ctx.Done():
+    return cacheEntry{}, ctx.Err()
+  case r := <-result:
+    if r.Err != nil {
+      return cacheEntry{}, r.Err
+    }
+    return r.Val.(cacheEntry), nil
+  }
+}
+
+// lastFetched returns when the newest entry of keys was cached, or the zero time when none is.
+// Expired entries count, since they are still the last data received.
+func (rc *responseCache) lastFetched(keys ...string) time.Time {
+  rc.mu.Lock()
+  defer rc.mu.Unlock()
+
+  var newest time.Time
+  for _, key := range keys {
+    if entry, ok := rc.entries[key]; ok && entry.fetchedAt.After(newest) {
+      newest = entry.fetchedAt
+    }
+  }
+  return newest
+}
+
+// clear drops all entries
+func (rc *responseCache) clear() {
+  rc.mu.Lock()
+  defer rc.mu.Unlock()
+
+  rc.entries = make(map[string]cacheEntry)
+}
+
+// invalidate drops the entries for keys
+func (rc *responseCache) invalidate(keys ...string) {
+  rc.mu.Lock()
+  defer rc.mu.Unlock()
+
+  for _, key := range keys {
+    delete(rc.entries, key)
+  }
+}
+
+// statsPageKeys are the cache entries the /stats page is built from
+var statsPageKeys = []string{"stats", "querysample", "blockedclients"}
+
+// pollAdGuard refreshes the cached stats and clients every interval until ctx is done, so page
+// loads are served from a warm cache
+func pollAdGuard(ctx context.Context, logger echo.Logger, interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    if err := refreshCache(ctx, currentConfig()); err != nil {
+      logger.Warn("background poll: ", err)
+    }
+
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+  }
+}
+
+// refreshCache fetches stats and clients from AdGuard Home and stores them in the cache
+func refreshCache(ctx context.Context, config *Config) error {
+  return fetchConcurrently(
+    func() error {
+      statsResponse, err := fetchStats(ctx, config, nil)
+      if err != nil {
+        return err
+      }
+      cache.set("stats", statsResponse)
+      return nil
+    },
+    func() error {
+      clientsResponse, err := fetchClients(ctx, config)
+      if err != nil {
+        return err
+      }
+      cache.set("clients", clientsResponse)
+      return nil
+    },
+  )
+}
+
+// getClients returns clients and when they were fetched, using the cache when it is fresh
+func getClients(ctx context.Context, config *Config) (*ClientsResponse, time.Time, error) {
+  entry, err := cache.load(ctx, "clients", config.cacheTTL(), func(ctx context.Context) (interface{}, error) {
+    return fetchClients(ctx, config)
+  })
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  return entry.value.(*ClientsResponse), entry.fetchedAt, nil
+}
+
+// getFilteringStatus returns the filtering status and when it was fetched, using the cache when it is fresh
+func getFilteringStatus(ctx context.Context, config *Config) (*FilteringStatus, time.Time, error) {
+  entry, err := cache.load(ctx, "filtering", config.cacheTTL(), func(ctx context.Context) (interface{}, error) {
+    return fetchFilteringStatus(ctx, config)
+  })
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  return entry.value.(*FilteringStatus), entry.fetchedAt, nil
+}
+
+// getRewrites returns the DNS rewrites and when they were fetched, using the cache when it is fresh
+func getRewrites(ctx context.Context, config *Config) ([]Rewrite, time.Time, error) {
+  entry, err := cache.load(ctx, "rewrites", config.cacheTTL(), func(ctx context.Context) (interface{}, error) {
+    return fetchRewrites(ctx, config)
+  })
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  return entry.value.([]Rewrite), entry.fetchedAt, nil
+}
+
+// getAccessList returns the access settings and when they were fetched, using the cache when it is fresh
+func getAccessList(ctx context.Context, config *Config) (*AccessList, time.Time, error) {
+  entry, err := cache.load(ctx, "access", config.cacheTTL(), func(ctx context.Context) (interface{}, error) {
+    return fetchAccessList(ctx, config)
+  })
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  return entry.value.(*AccessList), entry.fetchedAt, nil
+}
+
+// getStats returns stats and when they were fetched, using the cache when it is fresh
+func getStats(ctx context.Context, config *Config) (*StatsResponse, time.Time, error) {
+  return getStatsMaxAge(ctx, config, config.cacheTTL())
+}
+
+// getStatsMaxAge is getStats with an explicit maximum cache age
+func getStatsMaxAge(ctx context.Context, config *Config, ttl time.Duration) (*StatsResponse, time.Time, error) {
+  entry, err := cache.load(ctx, "stats", ttl, func(ctx context.Context) (interface{}, error) {
+    return fetchStats(ctx, config, nil)
+  })
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  return entry.value.(*StatsResponse), entry.fetchedAt, nil
+}
+
+// blockedPercent returns the share of queries that were blocked
+func blockedPercent(stats *StatsResponse) float64 {
+  return percentOf(stats.NumBlockedFiltering, stats.NumDNSQueries)
+}
+
+// summarizeStats extracts the headline numbers from a stats response
+func summarizeStats(stats *StatsResponse, fetchedAt time.Time) StatsSummary {
+  return StatsSummary{
+    Queries:         stats.NumDNSQueries,
+    Blocked:         stats.NumBlockedFiltering,
+    BlockedPercent:  blockedPercent(stats),
+    AvgProcessingMs: stats.AvgProcessingTime * 1000,
+    UpdatedAt:       fetchedAt,
+  }
+}
+
+// fetchConcurrently runs the given fetches in parallel and returns the first error
+func fetchConcurrently(fetches ...func() error) error {
+  var g errgroup.Group
+  for _, fetch := range fetches {
+    g.Go(fetch)
+  }
+  return g.Wait()
+}
+
+// mergeUpstreams joins the upstream count and average time lists by upstream name,
+// keeping the count order and appending upstreams that only have timing data
+func mergeUpstreams(stats *StatsResponse) []UpstreamStat {
+  var merged []UpstreamStat
+  index := make(map[string]int)
+
+  for _, item := range stats.TopUpstreamsResponses {
+    for name, count := range item {
+      index[name] = len(merged)
+      merged = append(merged, UpstreamStat{Upstream: name, Count: &count})
+      break // Only one key-value pair per map
+    }
+  }
+
+  for _, item := range stats.TopUpstreamsAvgTime {
+    for name, seconds := range item {
+      ms := seconds * 1000
+      if i, ok := index[name]; ok {
+        merged[i].AvgTimeMs = &ms
+      } else {
+        index[name] = len(merged)
+        merged = append(merged, UpstreamStat{Upstream: name, AvgTimeMs: &ms})
+      }
+      break // Only one key-value pair per map
+    }
+  }
+
+  return merged
+}
+
+// queryInt reads an integer query parameter clamped to min..max, returning def when missing or invalid
+func queryInt(c echo.Context, name string, def, min, max int) int {
+  value, err := strconv.Atoi(c.QueryParam(name))
+  if err != nil {
+    return def
+  }
+  if value < min {
+    return min
+  }
+  if value > max {
+    return max
+  }
+  return value
+}
+
+// parseTopN reads the ?top= query parameter, clamped to 1..maxTopN
+func parseTopN(c echo.Context) int {
+  return queryInt(c, "top", defaultTopN, 1, maxTopN)
+}
+
+// statsRangeLayouts are the accepted ?from= and ?to= formats, besides RFC 3339; the first is what a
+// datetime-local input submits
+var statsRangeLayouts = []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseStatsTime parses a ?from= or ?to= value, in loc unless it carries a UTC offset
+func parseStatsTime(value string, loc *time.Location) (time.Time, error) {
+  if t, err := time.Parse(time.RFC3339, value); err == nil {
+    return t, nil
+  }
+  for _, layout := range statsRangeLayouts {
+    if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+      return t, nil
+    }
+  }
+  return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 2006-01-02T15:04 or RFC 3339", value)
+}
+
+// parseStatsRange reads the ?from= and ?to= query parameters, nil when neither is set. to defaults to now.
+func parseStatsRange(c echo.Context, loc *time.Location) (*StatsRange, error) {
+  from, to := c.QueryParam("from"), c.QueryParam("to")
+  if from == "" && to == "" {
+    return nil, nil
+  }
+  if from == "" {
+    return nil, errors.New("from is required when to is set")
+  }
+
+  rng := &StatsRange{To: time.Now()}
+  var err error
+  if rng.From, err = parseStatsTime(from, loc); err != nil {
+    return nil, fmt.Errorf("from: %w", err)
+  }
+  if to != "" {
+    if rng.To, err = parseStatsTime(to, loc); err != nil {
+      return nil, fmt.Errorf("to: %w", err)
+    }
+  }
+  if !rng.From.Before(rng.To) {
+    return nil, errors.New("from must be before to")
+  }
+  return rng, nil
+}
+
+// paginate computes the page window for total items, clamping page into range
+func paginate(total, page, perPage int) Pagination {
+  totalPages := (total + perPage - 1) / perPage
+  if totalPages < 1 {
+    totalPages = 1
+  }
+  if page > totalPages {
+    page = totalPages
+  }
+
+  start := (page - 1) * perPage
+  end := start + perPage
+  if end > total {
+    end = total
+  }
+
+  return Pagination{
+    Page:       page,
+    PerPage:    perPage,
+    TotalPages: totalPages,
+    Total:      total,
+    Start:      start,
+    End:        end,
+  }
+}
+
+// copyQuery returns a shallow copy of query
+func copyQuery(query url.Values) url.Values {
+  q := url.Values{}
+  for k, v := range query {
+    q[k] = v
+  }
+  return q
+}
+
+// withQuery returns path with query plus key set to value (or removed when value is empty), HTML escaped
+func withQuery(path string, query url.Values, key, value string) string {
+  q := copyQuery(query)
+  if value == "" {
+    q.Del(key)
+  } else {
+    q.Set(key, value)
+  }
+
+  encoded := q.Encode()
+  if encoded == "" {
+    return template.HTMLEscapeString(path)
+  }
+  return template.HTMLEscapeString(path + "?" + encoded)
+}
+
+// generatePageNav generates previous/next links for a paginated page, keeping the other query parameters
+func generatePageNav(path string, query url.Values, p Pagination) string {
+  if p.TotalPages <= 1 {
+    return ""
+  }
+
+  query = copyQuery(query)
+  query.Set("per_page", strconv.Itoa(p.PerPage))
+  link := func(label string, page int) string {
+    return fmt.Sprintf(`<a href="%s">%s</a>`, withQuery(path, query, "page", strconv.Itoa(page)), label)
+  }
+
+  var sb strings.Builder
+  sb.WriteString(`<div class="page-nav">`)
+  if p.Page > 1 {
+    sb.WriteString(link("&laquo; First", 1))
+    sb.WriteString(link("&lsaquo; Previous", p.Page-1))
+  }
+  sb.WriteString(fmt.Sprintf(`<span>Page %d of %d</span>`, p.Page, p.TotalPages))
+  if p.Page < p.TotalPages {
+    sb.WriteString(link("Next &rsaquo;", p.Page+1))
+    sb.WriteString(link("Last &raquo;", p.TotalPages))
+  }
+  sb.WriteString(`</div>`)
+  return sb.String()
+}
+
+// formatMilliseconds formats a duration given in seconds as milliseconds
+func formatMilliseconds(seconds float64) string {
+  ms := seconds * 1000
+  switch {
+  case ms < 1:
+    return formatDecimal(ms, 3) + " ms"
+  case ms < 100:
+    return formatDecimal(ms, 2) + " ms"
+  default:
+    return formatDecimal(ms, 0) + " ms"
+  }
+}
+
+// locale returns display.locale, en-US when unset
+func (c *Config) locale() string {
+  if c.Display.Locale == "" {
+    return "en-US"
+  }
+  return c.Display.Locale
+}
+
+// numberPrinter returns the printer for display.locale
+func (c *Config) numberPrinter() *message.Printer {
+  if c.printer == nil {
+    return message.NewPrinter(language.AmericanEnglish)
+  }
+  return c.printer
+}
+
+// formatCount formats a count with the thousands separator of display.locale, e.g. 1,234 or 1.234
+func formatCount(n int) string {
+  return currentConfig().numberPrinter().Sprintf("%d", n)
+}
+
+// formatDecimal formats v with exactly digits fraction digits and the separators of display.locale
+func formatDecimal(v float64, digits int) string {
+  return currentConfig().numberPrinter().Sprint(number.Decimal(v, number.MinFractionDigits(digits), number.MaxFractionDigits(digits)))
+}
+
+// matchClient reports whether client matches any of the patterns, which may be IPs,
+// CIDR ranges or glob patterns matched against the IP and the name
+func matchClient(client Client, patterns []string) bool {
+  addr, isAddr := clientAddr(client.IP)
+  for _, pattern := range patterns {
+    if prefix, err := netip.ParsePrefix(pattern); err == nil && isAddr && prefix.Contains(addr) {
+      return true
+    }
+    if ok, _ := path.Match(pattern, client.IP); ok {
+      return true
+    }
+    if ok, _ := path.Match(pattern, client.Name); ok && client.Name != "" {
+      return true
+    }
+  }
+  return false
+}
+
+// visibleClients merges configured and auto clients and applies the display.only_clients
+// and display.hide_clients filters
+func visibleClients(config *Config, clientsResponse *ClientsResponse) []Client {
+  var allClients []Client
+  allClients = append(allClients, clientsResponse.Clients...)
+  allClients = append(allClients, clientsResponse.AutoClients...)
+
+  enrichWhois(allClients)
+
+  // The copies remember which list they came from
+  for i := range allClients {
+    allClients[i].Type = clientTypeAuto
+    if i < len(clientsResponse.Clients) {
+      allClients[i].Type = clientTypeConfigured
+    }
+  }
+
+  visible := allClients[:0:0]
+  for _, client := range allClients {
+    if clientVisible(config, client) {
+      visible = append(visible, client)
+    }
+  }
+  return visible
+}
+
+// clientVisible reports whether client passes the display.only_clients and display.hide_clients filters
+func clientVisible(config *Config, client Client) bool {
+  if len(config.Display.OnlyClients) > 0 && !matchClient(client, config.Display.OnlyClients) {
+    return false
+  }
+  return !matchClient(client, config.Display.HideClients)
+}
+
+// filterClients returns the clients whose IP or name contains query, ignoring case
+func filterClients(clients []Client, query string) []Client {
+  query = strings.ToLower(query)
+  matched := clients[:0:0]
+  for _, client := range clients {
+    if strings.Contains(strings.ToLower(client.IP), query) ||
+      strings.Contains(displayIP(client.IP), query) ||
+      strings.Contains(strings.ToLower(client.Name), query) {
+      matched = append(matched, client)
+    }
+  }
+  return matched
+}
+
+// displayIP normalizes a client identifier for display, compressing IPv6 addresses and CIDR ranges
+func displayIP(id string) string {
+  if addr, err := netip.ParseAddr(id); err == nil {
+    return addr.String()
+  }
+  if prefix, err := netip.ParsePrefix(id); err == nil {
+    return prefix.String()
+  }
+  // Hostnames, MAC addresses and ClientIDs are shown as-is
+  return id
+}
+
+// anonymizeIP masks a client IP to its network for display: IPv4 addresses to x.x.x.0 and IPv6
+// addresses to their /64 prefix. CIDR ranges are narrowed to at most those prefix lengths; other
+// identifiers are returned as displayIP shows them.
+func anonymizeIP(id string) string {
+  addr, bits := netip.Addr{}, -1
+  if a, err := netip.ParseAddr(id); err == nil {
+    addr = a.Unmap()
+  } else if prefix, err := netip.ParsePrefix(id); err == nil {
+    addr, bits = prefix.Addr().Unmap(), prefix.Bits()
+  } else {
+    return displayIP(id)
+  }
+
+  if addr.Is4() {
+    if bits < 0 || bits > 24 {
+      bits = 24
+    }
+    prefix := netip.PrefixFrom(addr, bits).Masked()
+    if bits == 24 {
+      return prefix.Addr().String()
+    }
+    return prefix.String()
+  }
+  if bits < 0 || bits > 64 {
+    bits = 64
+  }
+  return netip.PrefixFrom(addr.WithZone(""), bits).Masked().String()
+}
+
+// shownIP returns a client identifier as displayed, masked by anonymizeIP when anonymize is set
+func shownIP(id string, anonymize bool) string {
+  if anonymize {
+    return anonymizeIP(id)
+  }
+  return displayIP(id)
+}
+
+// anonymizeRequested reports whether a page shows masked client IPs: with display.anonymize_ips,
+// or for one request with ?anonymize=1
+func anonymizeRequested(c echo.Context, config *Config) bool {
+  return config.Display.AnonymizeIPs || c.QueryParam("anonymize") == "1"
+}
+
+// anonymizedClients returns a copy of clients with anonymizeIP applied to their IPs
+func anonymizedClients(clients []Client) []Client {
+  masked := slices.Clone(clients)
+  for i := range masked {
+    masked[i].IP = anonymizeIP(masked[i].IP)
+  }
+  return masked
+}
+
+// anonymizedCounts returns a copy of a stats top list keyed by client with anonymizeIP applied to
+// the keys. Clients in the same network keep separate rows.
+func anonymizedCounts(data []map[string]int) []map[string]int {
+  masked := make([]map[string]int, len(data))
+  for i, item := range data {
+    masked[i] = make(map[string]int, len(item))
+    for key, value := range item {
+      masked[i][anonymizeIP(key)] = value
+    }
+  }
+  return masked
+}
+
+// anonymizedStats returns a copy of stats with the top clients masked by anonymizeIP; the cached
+// response itself is shared and must not change
+func anonymizedStats(stats *StatsResponse) *StatsResponse {
+  masked := *stats
+  masked.TopClients = anonymizedCounts(stats.TopClients)
+  return &masked
+}
+
+// displayName returns the client name, falling back to a placeholder naming its source
+func displayName(client Client) string {
+  if client.Name != "" {
+    return client.Name
+  }
+  if client.Source != "" {
+    return fmt.Sprintf("(unnamed, %s)", currentConfig().sourceLabel(client.Source))
+  }
+  return "(unnamed)"
+}
+
+// clientAddr parses a client identifier as an address or the base address of a CIDR range
+func clientAddr(id string) (netip.Addr, bool) {
+  if addr, err := netip.ParseAddr(id); err == nil {
+    return addr.Unmap(), true
+  }
+  if prefix, err := netip.ParsePrefix(id); err == nil {
+    return prefix.Addr().Unmap(), true
+  }
+  return netip.Addr{}, false
+}
+
+// compareClientIPs orders IPv4 before IPv6 by numeric value, with non-address identifiers last
+func compareClientIPs(a, b string) int {
+  addrA, okA := clientAddr(a)
+  addrB, okB := clientAddr(b)
+  switch {
+  case okA && okB:
+    if cmp := addrA.Compare(addrB); cmp != 0 {
+      return cmp
+    }
+    return strings.Compare(a, b)
+  case okA:
+    return -1
+  case okB:
+    return 1
+  default:
+    return strings.Compare(a, b)
+  }
+}
+
+// sortClients sorts clients in place by key ("ip" or "name"), reporting whether key was recognized
+func sortClients(clients []Client, key string) bool {
+  switch key {
+  case "ip":
+    sort.SliceStable(clients, func(i, j int) bool {
+      return compareClientIPs(clients[i].IP, clients[j].IP) < 0
+    })
+  case "name":
+    sort.SliceStable(clients, func(i, j int) bool {
+      return strings.ToLower(clients[i].Name) < strings.ToLower(clients[j].Name)
+    })
+  default:
+    return false
+  }
+  return true
+}
+
+// pinnedClientSet returns the display.pinned_clients addresses, normalized like displayIP
+func pinnedClientSet(config *Config) map[string]bool {
+  pinned := make(map[string]bool)
+  for _, ip := range config.Display.PinnedClients {
+    pinned[displayIP(ip)] = true
+  }
+  return pinned
+}
+
+// pinClients moves the pinned clients to the front, keeping the order of the sort within both
+// the pinned clients and the rest
+func pinClients(clients []Client, pinned map[string]bool) {
+  if len(pinned) == 0 {
+    return
+  }
+  sort.SliceStable(clients, func(i, j int) bool {
+    return pinned[displayIP(clients[i].IP)] && !pinned[displayIP(clients[j].IP)]
+  })
+}
+
+// emptyTableRow returns a table row spanning all columns for tables without data
+func emptyTableRow(columns int) string {
+  return fmt.Sprintf(`
+      <tr>
+        <td colspan="%d" class="empty-row">No data available</td>
+      </tr>`, columns)
+}
+
+// generateHTMLTable generates an HTML table from the clients data with the given columns;
+// queryCounts (keyed by normalized IP) is only needed for the "queries" column. Each cell is
+// labelled with its column header for the card layout. Rows of pinned clients (keyed like
+// queryCounts) are highlighted.
+func generateHTMLTable(clients []Client, columns []string, queryCounts map[string]int, pinned map[string]bool, maxRows int, cards, anonymize bool) string {
+  var sb strings.Builder
+
+  total := len(clients)
+  if total > maxRows {
+    clients = clients[:maxRows]
+  }
+
+  // Rows turn into cards on narrow screens, or always with cards (?layout=cards)
+  class := "table-container client-table"
+  if cards {
+    class += " cards"
+  }
+  sb.WriteString(`<div class="` + class + `"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
+    <thead>
+      <tr>`)
+  for _, column := range columns {
+    if column == "queries" {
+      sb.WriteString(`
+        <th style="text-align: right;">` + clientColumnHeaders[column] + `</th>`)
+    } else {
+      sb.WriteString(`
+        <th>` + clientColumnHeaders[column] + `</th>`)
+    }
+  }
+  sb.WriteString(`
+      </tr>
+    </thead>
+    <tbody>`)
+
+  if len(clients) == 0 {
+    sb.WriteString(emptyTableRow(len(columns)))
+  }
+
+  for _, client := range clients {
+    if pinned[displayIP(client.IP)] {
+      sb.WriteString(`
+      <tr class="pinned-client" title="Pinned in display.pinned_clients">`)
+    } else {
+      sb.WriteString(`
+      <tr>`)
+    }
+    for _, column := range columns {
+      sb.WriteString(`
+        ` + generateClientCell(client, column, queryCounts, anonymize))
+    }
+    sb.WriteString(`
+      </tr>`)
+  }
+
+  sb.WriteString(`</tbody></table></div>`)
+  sb.WriteString(generateTruncatedNotice(len(clients), total))
+  return sb.String()
+}
+
+// generateTruncatedNotice generates the notice below a table cut to display.max_rows, or nothing
+// when every row was shown
+func generateTruncatedNotice(shown, total int) string {
+  if shown >= total {
+    return ""
+  }
+  return fmt.Sprintf(`<p class="truncated-notice">Showing first %d of %d rows.</p>`, shown, total)
+}
+
+// copyButton generates a button that copies value to the clipboard (see assets/copy.js), nothing for an empty value
+func copyButton(value string) string {
+  if value == "" {
+    return ""
+  }
+  escaped := template.HTMLEscapeString(value)
+  return fmt.Sprintf(`<button type="button" class="copy-button" data-copy="%s" title="Copy %s" aria-label="Copy %s">⧉</button>`, escaped, escaped, escaped)
+}
+
+// generateClientCell generates the clients table cell for one column, masking the IP with
+// anonymize. Masked IPs are not linked, as the client page URL would reveal the full address.
+func generateClientCell(client Client, column string, queryCounts map[string]int, anonymize bool) string {
+  td := fmt.Sprintf(`<td data-label="%s">`, clientColumnHeaders[column])
+  switch column {
+  case "ip":
+    if anonymize {
+      masked := anonymizeIP(client.IP)
+      return td + template.HTMLEscapeString(masked) + copyButton(masked) + `</td>`
+    }
+    return fmt.Sprintf(`%s<a href="%s">%s</a>%s</td>`,
+      td,
+      template.HTMLEscapeString(appURL("/clients/"+url.PathEscape(client.IP))),
+      template.HTMLEscapeString(displayIP(client.IP)),
+      copyButton(displayIP(client.IP)),
+    )
+  case "name":
+    return td + template.HTMLEscapeString(displayName(client)) + `</td>`
+  case "source":
+    return td + orDash(currentConfig().sourceLabel(client.Source)) + `</td>`
+  case "country":
+    return td + orDash(client.WhoisInfo.Country) + `</td>`
+  case "organization":
+    return td + orDash(client.WhoisInfo.OrgName) + `</td>`
+  case "city":
+    return td + orDash(client.WhoisInfo.City) + `</td>`
+  case "tags":
+    var sb strings.Builder
+    sb.WriteString(td)
+    for _, tag := range client.Tags {
+      sb.WriteString(fmt.Sprintf(`<a class="tag" href="%s">%s</a> `,
+        withQuery(appURL("/clients"), nil, "tag", tag),
+        template.HTMLEscapeString(tag),
+      ))
+    }
+    sb.WriteString(`</td>`)
+    return sb.String()
+  case "type":
+    return td + clientTypeLabels[client.Type] + `</td>`
+  case "queries":
+    if count, ok := queryCounts[displayIP(client.IP)]; ok {
+      return fmt.Sprintf(`<td data-label="%s" style="text-align: right;">%s</td>`, clientColumnHeaders[column], formatCount(count))
+    }
+    return fmt.Sprintf(`<td data-label="%s" style="text-align: right;">—</td>`, clientColumnHeaders[column])
+  }
+  return `<td></td>`
+}
+
+// topClientCounts returns the query counts from the top clients list keyed by normalized IP
+func topClientCounts(stats *StatsResponse) map[string]int {
+  counts := make(map[string]int)
+  for _, item := range stats.TopClients {
+    for key, value := range item {
+      counts[displayIP(key)] = value
+    }
+  }
+  return counts
+}
+
+// findClient returns the client whose identifier matches id, comparing normalized addresses
+func findClient(clients []Client, id string) (Client, bool) {
+  id = displayIP(id)
+  for _, client := range clients {
+    if displayIP(client.IP) == id {
+      return client, true
+    }
+  }
+  return Client{}, false
+}
+
+// clientQueryCount returns the query count for a client identifier from the top clients list
+func clientQueryCount(stats *StatsResponse, id string) (int, bool) {
+  id = displayIP(id)
+  for _, item := range stats.TopClients {
+    for key, value := range item {
+      if displayIP(key) == id {
+        return value, true
+      }
+    }
+  }
+  return 0, false
+}
+
+// generateClientContent generates the detail page for a single client, with clientStats below the summary
+func generateClientContent(client Client, stats *StatsResponse, clientStats string, anonymize bool) string {
+  queries := "Not among the top clients"
+  if count, ok := clientQueryCount(stats, client.IP); ok {
+    queries = fmt.Sprintf("%s (%s%% of all queries)", formatCount(count), formatDecimal(percentOf(count, stats.NumDNSQueries), 1))
+  }
+
+  return fmt.Sprintf(`<div class="header-section">
+    <h1>%s</h1>
+    <p><a href="%s">&laquo; All clients</a></p>
+</div>
+
+<div class="summary">
+    <p><strong>IP Address:</strong> %s</p>
+    <p><strong>Name:</strong> %s</p>
+    <p><strong>Source:</strong> %s</p>
+    <p><strong>Country:</strong> %s</p>
+    <p><strong>Organization:</strong> %s</p>
+    <p><strong>City:</strong> %s</p>
+    <p><strong>Tags:</strong> %s</p>
+    <p><strong>Queries (%s):</strong> %s</p>
+</div>
+%s`,
+    template.HTMLEscapeString(displayName(client)),
+    template.HTMLEscapeString(appURL("/clients")),
+    template.HTMLEscapeString(shownIP(client.IP, anonymize)),
+    orDash(client.Name),
+    orDash(currentConfig().sourceLabel(client.Source)),
+    orDash(client.WhoisInfo.Country),
+    orDash(client.WhoisInfo.OrgName),
+    orDash(client.WhoisInfo.City),
+    orDash(strings.Join(client.Tags, ", ")),
+    template.HTMLEscapeString("last "+formatStatsPeriod(stats)),
+    queries,
+    clientStats,
+  )
+}
+
+// generateClientStats generates the per-client stats section of the client detail page, or a
+// notice when they could not be obtained (stats is nil)
+func generateClientStats(stats *ClientStats, limit, maxRows int) string {
+  if stats == nil {
+    return `<h3>Recent Activity</h3>
+<p class="truncated-notice">Per-client stats unavailable: the query log could not be read.</p>`
+  }
+
+  if stats.Sampled == 0 {
+    return `<h3>Recent Activity</h3>
+<p>No queries from this client are in the recent query log.</p>`
+  }
+
+  return fmt.Sprintf(`<h3>Recent Activity</h3>
+<p>Of the last %s queries from this client in the query log, %s (%s%%) were blocked.</p>
+%s`,
+    formatCount(stats.Sampled),
+    formatCount(stats.Blocked),
+    formatDecimal(percentOf(stats.Blocked, stats.Sampled), 1),
+    generateStatsTable("Top Domains", stats.TopDomains, "Count", limit, maxRows),
+  )
+}
+
+// orDash returns value HTML escaped, or "—" when it is empty
+func orDash(value string) string {
+  if value == "" {
+    return "—"
+  }
+  return template.HTMLEscapeString(value)
+}
+
+// percentOf returns value as a percentage of total, or 0 when total is zero
+func percentOf(value, total int) float64 {
+  if total == 0 {
+    return 0
+  }
+  return float64(value) / float64(total) * 100
+}
+
+// generateStatsTable generates an HTML table for stats data
+func generateStatsTable(title string, data []map[string]int, valueLabel string, limit, maxRows int) string {
+  var sb strings.Builder
+
+  total := 0
+  for _, item := range data {
+    for _, value := range item {
+      total += value
+    }
+  }
+
+  if len(data) > limit {
+    data = data[:limit]
+  }
+  shown := min(len(data), maxRows)
+
+  sb.WriteString(fmt.Sprintf(`<h3>%s</h3>`, title))
+  sb.WriteString(generateStatsTableStart(valueLabel))
+
+  if len(data) == 0 {
+    sb.WriteString(emptyTableRow(4))
+  }
+
+  barMax := inlineBarMax(data[:shown])
+  for i, item := range data[:shown] {
+    for key, value := range item {
+      sb.WriteString(generateStatsRow(i+1, key, value, total, barMax))
+      break // Only one key-value pair per map
+    }
+  }
+
+  sb.WriteString(`</tbody></table></div>`)
+  sb.WriteString(generateTruncatedNotice(shown, len(data)))
+  return sb.String()
+}
+
+// generateStatsTableStart generates the opening of a stats table up to its body
+func generateStatsTableStart(valueLabel string) string {
+  return `<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
+    <thead>
+      <tr>
+        <th>#</th>
+        <th>Name</th>
+        <th style="text-align: right;">` + valueLabel + `</th>
+        <th style="text-align: right;">%</th>
+      </tr>
+    </thead>
+    <tbody>`
+}
+
+// inlineBarMax returns the largest value in the rows shown, which the inline bars are scaled to,
+// or 0 when display.inline_bars is off
+func inlineBarMax(data []map[string]int) int {
+  if !currentConfig().Display.InlineBars {
+    return 0
+  }
+  barMax := 0
+  for _, item := range data {
+    for _, value := range item {
+      barMax = max(barMax, value)
+    }
+  }
+  return barMax
+}
+
+// generateStatsRow generates one ranked stats table row, with value as a share of total. With a
+// positive barMax the count cell gets a bar behind it, as wide as value is of barMax. Keys come
+// from AdGuard Home and its query log, where any client can choose the domain, so they are escaped.
+func generateStatsRow(rank int, key string, value, total, barMax int) string {
+  countCell := `<td style="text-align: right;">`
+  if barMax > 0 {
+    // CSS needs a dot as decimal separator whatever display.locale is
+    countCell = fmt.Sprintf(`<td class="inline-bar" style="text-align: right; --bar: %.1f%%;">`, percentOf(value, barMax))
+  }
+
+  return fmt.Sprintf(`
+        <tr>
+          <td>%d</td>
+          <td>%s</td>
+          %s%s</td>
+          <td style="text-align: right;">%s%%</td>
+        </tr>`,
+    rank,
+    template.HTMLEscapeString(key),
+    countCell,
+    formatCount(value),
+    formatDecimal(percentOf(value, total), 1),
+  )
+}
+
+// uncategorizedGroup holds the top domains missing from the sample categories come from
+const uncategorizedGroup = "Not in recent blocked queries"
+
+// generateGroupedStatsTable generates a stats table split into collapsible sections by the
+// category of each name, largest section first. Ranks and percentages stay those of the whole
+// list. Without categories it is the flat generateStatsTable.
+func generateGroupedStatsTable(title string, data []map[string]int, categories map[string]string, valueLabel string, limit, maxRows int) string {
+  if len(categories) == 0 || len(data) == 0 {
+    return generateStatsTable(title, data, valueLabel, limit, maxRows)
+  }
+
+  total := 0
+  for _, item := range data {
+    for _, value := range item {
+      total += value
+    }
+  }
+
+  if len(data) > limit {
+    data = data[:limit]
+  }
+  shown := min(len(data), maxRows)
+
+  // Keep the overall rank of every row while grouping, and scale the bars across all sections
+  barMax := inlineBarMax(data[:shown])
+  var order []string
+  rows := make(map[string][]string)
+  sums := make(map[string]int)
+  for i, item := range data[:shown] {
+    for key, value := range item {
+      category, ok := categories[key]
+      if !ok {
+        category = uncategorizedGroup
+      }
+      if _, seen := rows[category]; !seen {
+        order = append(order, category)
+      }
+      rows[category] = append(rows[category], generateStatsRow(i+1, key, value, total, barMax))
+      sums[category] += value
+      break // Only one key-value pair per map
+    }
+  }
+  sort.SliceStable(order, func(i, j int) bool {
+    if (order[i] == uncategorizedGroup) != (order[j] == uncategorizedGroup) {
+      return order[j] == uncategorizedGroup
+    }
+    return sums[order[i]] > sums[order[j]]
+  })
+
+  var sb strings.Builder
+  sb.WriteString(fmt.Sprintf(`<h3>%s</h3>`, title))
+  for _, category := range order {
+    sb.WriteString(fmt.Sprintf(`
+<details class="stats-group" open>
+    <summary>%s <span class="stats-group-count">%s · %s%%</span></summary>
+    %s%s</tbody></table></div>
+</details>`,
+      template.HTMLEscapeString(category),
+      pluralCount(len(rows[category]), "domain", "domains"),
+      formatDecimal(percentOf(sums[category], total), 1),
+      generateStatsTableStart(valueLabel),
+      strings.Join(rows[category], ""),
+    ))
+  }
+  sb.WriteString(generateTruncatedNotice(shown, len(data)))
+  return sb.String()
+}
+
+// pluralCount formats n with the singular or plural noun, e.g. "1 domain" or "1,234 domains"
+func pluralCount(n int, singular, plural string) string {
+  if n == 1 {
+    return formatCount(n) + " " + singular
+  }
+  return formatCount(n) + " " + plural
+}
+
+// generateUpstreamsTable generates a single HTML table correlating upstream counts, their share of
+// all responses and average times
+func generateUpstreamsTable(title string, upstreams []UpstreamStat, query url.Values, sortKey string, desc bool, limit, maxRows int) string {
+  var sb strings.Builder
+
+  // Shares are of every response, including upstreams beyond the limit
+  total := 0
+  for _, upstream := range upstreams {
+    if upstream.Count != nil {
+      total += *upstream.Count
+    }
+  }
+
+  if len(upstreams) > limit {
+    upstreams = upstreams[:limit]
+  }
+  shown := min(len(upstreams), maxRows)
+
+  // The sorted column shows its direction and links to the reverse order
+  sortHeader := func(key, label string) string {
+    q := copyQuery(query)
+    q.Set("sort", key)
+    order := ""
+    if key == sortKey {
+      arrow := "&#9650;"
+      order = "desc"
+      if desc {
+        arrow, order = "&#9660;", "asc"
+      }
+      label += " " + arrow
+    }
+    return fmt.Sprintf(`<a href="%s">%s</a>`, withQuery(appURL("/upstreams"), q, "order", order), label)
+  }
+  
+  sb.WriteString(fmt.Sprintf(`<h3>%s</h3>`, title))
+  sb.WriteString(`<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
+    <thead>
+      <tr>
+        <th>#</th>
+        <th>Upstream</th>
+        <th style="text-align: right;">` + sortHeader("count", "Count") + `</th>
+        <th style="text-align: right;">Share</th>
+        <th style="text-align: right;">` + sortHeader("time", "Avg Time") + `</th>
+      </tr>
+    </thead>
+    <tbody>`)
+
+  if len(upstreams) == 0 {
+    sb.WriteString(emptyTableRow(5))
+  }
+
+  for i, upstream := range upstreams[:shown] {
+    count, share := "—", "—"
+    if upstream.Count != nil {
+      count = formatCount(*upstream.Count)
+      share = formatDecimal(percentOf(*upstream.Count, total), 1) + "%"
+    }
+    avgTime := `<td style="text-align: right;">—</td>`
+    if upstream.AvgTimeMs != nil {
+      seconds := *upstream.AvgTimeMs / 1000
+      avgTime = fmt.Sprintf(`<td style="text-align: right;" title="%.6f s">%s</td>`, seconds, formatMilliseconds(seconds))
+    }
+
+    sb.WriteString(fmt.Sprintf(`
+        <tr>
+          <td>%d</td>
+          <td>%s</td>
+          <td style="text-align: right;">%s</td>
+          <td style="text-align: right;">%s</td>
+          %s
+        </tr>`,
+      i+1,
+      template.HTMLEscapeString(upstream.Upstream),
+      count,
+      share,
+      avgTime,
+    ))
+  }
+
+  sb.WriteString(`</tbody></table></div>`)
+  sb.WriteString(generateTruncatedNotice(shown, len(upstreams)))
+  return sb.String()
+}
+
+// defaultUpstreamSort is the /upstreams sort key without ?sort=
+const defaultUpstreamSort = "count"
+
+// upstreamSortDesc returns whether the /upstreams ?order= parameter sorts key descending. Without
+// it counts sort highest first and times fastest first.
+func upstreamSortDesc(key, order string) bool {
+  switch order {
+  case "asc":
+    return false
+  case "desc":
+    return true
+  }
+  return key == "count"
+}
+
+// sortUpstreams sorts upstreams in place by "count" or "time", descending when desc is set, with
+// missing values last and ties in their original order, reporting whether key was recognized
+func sortUpstreams(upstreams []UpstreamStat, key string, desc bool) bool {
+  var value func(u UpstreamStat) (float64, bool)
+  switch key {
+  case "count":
+    value = func(u UpstreamStat) (float64, bool) {
+      if u.Count == nil {
+        return 0, false
+      }
+      return float64(*u.Count), true
+    }
+  case "time":
+    value = func(u UpstreamStat) (float64, bool) {
+      if u.AvgTimeMs == nil {
+        return 0, false
+      }
+      return *u.AvgTimeMs, true
+    }
+  default:
+    return false
+  }
+
+  sort.SliceStable(upstreams, func(i, j int) bool {
+    a, aok := value(upstreams[i])
+    b, bok := value(upstreams[j])
+    if !aok || !bok {
+      return aok
+    }
+    if desc {
+      return a > b
+    }
+    return a < b
+  })
+  return true
+}
+
+// generateHomeContent generates the home page content
+func generateHomeContent(brand string, stats *StatsResponse, clientCount int, liveUpdates bool, links []Link, locale string) string {
+  // Stats (nil) and the client count (negative) may each be unavailable; their cards show a dash
+  // under an error banner
+  period, queries, blocked, percent, avgTime, chart := "", "—", "—", "—", "—", ""
+  var banners strings.Builder
+  if stats != nil {
+    period = fmt.Sprintf("<p>Overview of the last %s.</p>", template.HTMLEscapeString(formatStatsPeriod(stats)))
+    queries = formatCount(stats.NumDNSQueries)
+    blocked = formatCount(stats.NumBlockedFiltering)
+    percent = formatDecimal(blockedPercent(stats), 2) + "%"
+    avgTime = formatMilliseconds(stats.AvgProcessingTime)
+    chart = "<h3>Allowed vs Blocked Queries</h3>\n" + generateQueryChart(stats)
+  } else {
+    banners.WriteString(`<div class="flash flash-error">Statistics could not be fetched from AdGuard Home, so query numbers are missing. Check the Aghamon log for details.</div>`)
+  }
+  clients := "—"
+  if clientCount >= 0 {
+    clients = formatCount(clientCount)
+  } else {
+    banners.WriteString(`<div class="flash flash-error">Clients could not be fetched from AdGuard Home, so the client count is missing. Check the Aghamon log for details.</div>`)
+  }
+
+  script := ""
+  if liveUpdates {
+    script = fmt.Sprintf(`<script src="%s" data-socket="%s" data-locale="%s"></script>`,
+      template.HTMLEscapeString(appURL("/static/live.js")),
+      template.HTMLEscapeString(appURL("/ws/stats")),
+      template.HTMLEscapeString(locale),
+    )
+  }
+
+  return fmt.Sprintf(`<h1>Welcome to %s</h1>
+%s
+%s
+
+<div class="overview-cards">
+    <div class="metric-card">
+        <div class="metric-label">Total Queries</div>
+        <div class="metric-value" data-metric="queries">%s</div>
+    </div>
+    <div class="metric-card">
+        <div class="metric-label">Blocked Queries</div>
+        <div class="metric-value" data-metric="blocked">%s</div>
+    </div>
+    <div class="metric-card">
+        <div class="metric-label">Blocked</div>
+        <div class="metric-value" data-metric="blocked_percent">%s</div>
+    </div>
+    <div class="metric-card">
+        <div class="metric-label">Avg Processing Time</div>
+        <div class="metric-value" data-metric="avg_processing_ms">%s</div>
+    </div>
+    <div class="metric-card">
+        <div class="metric-label">Clients</div>
+        <div class="metric-value">%s</div>
+    </div>
+</div>
+
+%s
+
+<div style="display: grid; grid-template-columns: repeat(auto-fit, minmax(250px, 1fr)); gap: 20px; margin-top: 30px;">
+    <div style="background: var(--accent-bg); padding: 20px; border-radius: 5px; text-align: center;">
+        <h3>%s %s</h3>
+        <p>%s</p>
+        <a href="%s" style="display: inline-block; background: var(--accent); color: var(--on-accent); padding: 10px 20px; text-decoration: none; border-radius: 3px;">View Clients</a>
+    </div>
+    
+    <div style="background: var(--success-bg); padding: 20px; border-radius: 5px; text-align: center;">
+        <h3>%s %s</h3>
+        <p>%s</p>
+        <a href="%s" style="display: inline-block; background: var(--success); color: var(--on-accent); padding: 10px 20px; text-decoration: none; border-radius: 3px;">View Stats</a>
+    </div>
+    
+    <div style="background: var(--warning-bg); padding: 20px; border-radius: 5px; text-align: center;">
+        <h3>%s %s</h3>
+        <p>%s</p>
+        <a href="%s" style="display: inline-block; background: var(--warning); color: var(--on-accent); padding: 10px 20px; text-decoration: none; border-radius: 3px;">View Upstreams</a>
+    </div>
+</div>
+%s
+%s`,
+    template.HTMLEscapeString(brand),
+    period,
+    banners.String(),
+    queries,
+    blocked,
+    percent,
+    avgTime,
+    clients,
+    chart,
+    sectionFor("/clients").Icon, sectionFor("/clients").Label, sectionFor("/clients").Description,
+    template.HTMLEscapeString(appURL("/clients")),
+    sectionFor("/stats").Icon, sectionFor("/stats").Label, sectionFor("/stats").Description,
+    template.HTMLEscapeString(appURL("/stats")),
+    sectionFor("/upstreams").Icon, sectionFor("/upstreams").Label, sectionFor("/upstreams").Description,
+    template.HTMLEscapeString(appURL("/upstreams")),
+    generateQuickLinks(links),
+    script,
+  )
+}
+
+// generateQuickLinks generates the server.links section of the home page, or nothing without links
+func generateQuickLinks(links []Link) string {
+  if len(links) == 0 {
+    return ""
+  }
+
+  var sb strings.Builder
+  sb.WriteString(`
+<h3>Quick Links</h3>
+<ul class="quick-links">`)
+  for _, link := range links {
+    // External links open in a new tab, paths on this host in the same one
+    target := ""
+    if !strings.HasPrefix(link.URL, "/") {
+      target = ` target="_blank" rel="noopener noreferrer"`
+    }
+    sb.WriteString(fmt.Sprintf(`
+    <li><a href="%s"%s>%s</a></li>`,
+      template.HTMLEscapeString(link.URL),
+      target,
+      template.HTMLEscapeString(link.Label),
+    ))
+  }
+  sb.WriteString(`
+</ul>`)
+  return sb.String()
+}
+
+// generateQueryChart generates a server-side SVG stacked bar chart of allowed and blocked
+// queries per time unit
+func generateQueryChart(stats *StatsResponse) string {
+  queries := stats.DNSQueries
+  if len(queries) == 0 {
+    return `<p class="empty-row">No data available</p>`
+  }
+
+  // Both series end at the current time unit, so align them at the end if their lengths differ
+  blockedAt := func(i int) int {
+    j := i - (len(queries) - len(stats.BlockedFiltering))
+    if j < 0 || j >= len(stats.BlockedFiltering) {
+      return 0
+    }
+    blocked := stats.BlockedFiltering[j]
+    if blocked < 0 {
+      return 0
+    }
+    if blocked > queries[i] {
+      return queries[i]
+    }
+    return blocked
+  }
+
+  peak := 1
+  for _, total := range queries {
+    if total > peak {
+      peak = total
+    }
+  }
+
+  const width, height = 720.0, 200.0
+  slot := width / float64(len(queries))
+  barWidth := slot * 0.8
+
+  var sb strings.Builder
+  sb.WriteString(fmt.Sprintf(`<svg class="query-chart" viewBox="0 0 %.0f %.0f" preserveAspectRatio="none" role="img" aria-label="Allowed and blocked queries per %s">`,
+    width, height, template.HTMLEscapeString(periodUnit(1, stats.TimeUnits))))
+
+  for i, total := range queries {
+    if total < 0 {
+      total = 0
+    }
+    blocked := blockedAt(i)
+    allowed := total - blocked
+
+    x := float64(i)*slot + (slot-barWidth)/2
+    allowedHeight := float64(allowed) / float64(peak) * height
+    blockedHeight := float64(blocked) / float64(peak) * height
+
+    sb.WriteString(fmt.Sprintf(`<g><title>%d allowed, %d blocked</title>`, allowed, blocked))
+    sb.WriteString(fmt.Sprintf(`<rect class="allowed" x="%.2f" y="%.2f" width="%.2f" height="%.2f"/>`,
+      x, height-allowedHeight, barWidth, allowedHeight))
+    sb.WriteString(fmt.Sprintf(`<rect class="blocked" x="%.2f" y="%.2f" width="%.2f" height="%.2f"/>`,
+      x, height-allowedHeight-blockedHeight, barWidth, blockedHeight))
+    sb.WriteString(`</g>`)
+  }
+
+  sb.WriteString(`</svg>
+<div class="chart-legend"><span class="allowed">Allowed</span> <span class="blocked">Blocked</span></div>`)
+  return sb.String()
+}
+
+// clientListQuery returns the clients page parameters that filter and sort links keep
+func clientListQuery(query url.Values) url.Values {
+  return url.Values{"sort": query["sort"], "per_page": query["per_page"], "tag": query["tag"], "type": query["type"], "q": query["q"]}
+}
+
+// generateSortLinks generates the sort order links for the clients page
+func generateSortLinks(query url.Values, current string) string {
+  query = clientListQuery(query)
+
+  var sb strings.Builder
+  sb.WriteString(`<p class="sort-links">Sort by:`)
+  for _, option := range []struct{ key, label string }{
+    {"", "Default"},
+    {"ip", "IP Address"},
+    {"name", "Name"},
+  } {
+    if option.key == current {
+      sb.WriteString(fmt.Sprintf(` <strong>%s</strong>`, option.label))
+    } else {
+      sb.WriteString(fmt.Sprintf(` <a href="%s">%s</a>`, withQuery(appURL("/clients"), query, "sort", option.key), option.label))
+    }
+  }
+  sb.WriteString(`</p>`)
+  return sb.String()
+}
+
+// generateClientSearch generates the client search form, with a clear link while a search is active
+func generateClientSearch(query url.Values, search string) string {
+  path := appURL("/clients")
+
+  var hidden strings.Builder
+  for _, key := range []string{"sort", "per_page", "tag", "type"} {
+    if value := query.Get(key); value != "" {
+      hidden.WriteString(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, key, template.HTMLEscapeString(value)))
+    }
+  }
+
+  clear := ""
+  if search != "" {
+    clear = fmt.Sprintf(`<span>Results for <strong>%s</strong> &middot; <a href="%s">Clear</a></span>`,
+      template.HTMLEscapeString(search),
+      withQuery(path, clientListQuery(query), "q", ""),
+    )
+  }
+
+  return fmt.Sprintf(`<form class="filter-form" method="GET" action="%s">
+        <input type="search" name="q" value="%s" placeholder="IP or name">
+        %s
+        <button type="submit">Search</button>
+        %s
+    </form>`,
+    template.HTMLEscapeString(path),
+    template.HTMLEscapeString(search),
+    hidden.String(),
+    clear,
+  )
+}
+
+// generateTagFilter generates the tag filter links for the clients page from the tags in use
+func generateTagFilter(query url.Values, tags []string, current string) string {
+  if len(tags) == 0 {
+    return ""
+  }
+  query = clientListQuery(query)
+
+  var sb strings.Builder
+  sb.WriteString(`<p class="tag-filter">Tag:`)
+  if current == "" {
+    sb.WriteString(` <strong>All</strong>`)
+  } else {
+    sb.WriteString(fmt.Sprintf(` <a href="%s">All</a>`, withQuery(appURL("/clients"), query, "tag", "")))
+  }
+  for _, tag := range tags {
+    if tag == current {
+      sb.WriteString(fmt.Sprintf(` <strong class="tag">%s</strong>`, template.HTMLEscapeString(tag)))
+    } else {
+      sb.WriteString(fmt.Sprintf(` <a class="tag" href="%s">%s</a>`, withQuery(appURL("/clients"), query, "tag", tag), template.HTMLEscapeString(tag)))
+    }
+  }
+  sb.WriteString(`</p>`)
+  return sb.String()
+}
+
+// generateTypeFilter generates the configured/auto client type filter links for the clients page
+func generateTypeFilter(query url.Values, current string) string {
+  query = clientListQuery(query)
+
+  var sb strings.Builder
+  sb.WriteString(`<p class="type-filter">Type:`)
+  for _, option := range []struct{ key, label string }{
+    {"", "All"},
+    {clientTypeConfigured, clientTypeLabels[clientTypeConfigured]},
+    {clientTypeAuto, clientTypeLabels[clientTypeAuto]},
+  } {
+    if option.key == current {
+      sb.WriteString(fmt.Sprintf(` <strong>%s</strong>`, option.label))
+    } else {
+      sb.WriteString(fmt.Sprintf(` <a href="%s">%s</a>`, withQuery(appURL("/clients"), query, "type", option.key), option.label))
+    }
+  }
+  sb.WriteString(`</p>`)
+  return sb.String()
+}
+
+// generateLayoutToggle generates the links switching the clients list between the table and the card layout
+func generateLayoutToggle(query url.Values, cards bool) string {
+  if cards {
+    return fmt.Sprintf(`<p class="layout-toggle">Layout: <a href="%s">Table</a> <strong>Cards</strong></p>`, withQuery(appURL("/clients"), query, "layout", ""))
+  }
+  return fmt.Sprintf(`<p class="layout-toggle">Layout: <strong>Table</strong> <a href="%s">Cards</a></p>`, withQuery(appURL("/clients"), query, "layout", "cards"))
+}
+
+// clientTags returns the sorted set of tags used by clients
+func clientTags(clients []Client) []string {
+  var tags []string
+  for _, client := range clients {
+    for _, tag := range client.Tags {
+      if !slices.Contains(tags, tag) {
+        tags = append(tags, tag)
+      }
+    }
+  }
+  sort.Strings(tags)
+  return tags
+}
+
+// generateLastUpdated generates the line showing when the page data was fetched from AdGuard Home,
+// with a link that reloads it past the cache unless refreshURL is empty
+func generateLastUpdated(fetchedAt time.Time, refreshURL string) string {
+  refresh := ""
+  if refreshURL != "" {
+    refresh = fmt.Sprintf(` | <a href="%s">Refresh</a>`, refreshURL)
+  }
+  return fmt.Sprintf(`<p class="last-updated">Last updated: %s%s</p>`, fetchedAt.Format("2006-01-02 15:04:05 MST"), refresh)
+}
+
+// refreshURL returns the current page with ?nocache=1, for the Refresh link
+func refreshURL(c echo.Context) string {
+  return withQuery(c.Request().URL.Path, c.QueryParams(), "nocache", "1")
+}
+
+// generateClientsContent generates the clients page content
+func generateClientsContent(p Pagination, query url.Values, sortKey, filters, clientsTable string) string {
+  showing := "No clients to show"
+  if p.Total > 0 {
+    showing = fmt.Sprintf("Showing %s–%s of %s", formatCount(p.Start+1), formatCount(p.End), formatCount(p.Total))
+  }
+  pageNav := generatePageNav(appURL("/clients"), query, p)
+
+  return fmt.Sprintf(`<div class="header-section">
+    <h1>DNS Clients</h1>
+    <p>Total clients: %s</p>
+    <p>%s</p>
+    %s
+    %s
+</div>
+%s
+%s`, formatCount(p.Total), showing, generateSortLinks(query, sortKey), filters, clientsTable, pageNav)
+}
+
+// isBlockedQuery reports whether AdGuard Home blocked the query, as opposed to allowing or rewriting it
+func isBlockedQuery(entry QueryLogEntry) bool {
+  return strings.HasPrefix(entry.Reason, "Filtered") && entry.Reason != "FilteredSafeSearch"
+}
+
+// formatQueryTime formats a query log timestamp in loc, falling back to the raw value
+func formatQueryTime(timestamp string, loc *time.Location) string {
+  t, err := time.Parse(time.RFC3339Nano, timestamp)
+  if err != nil {
+    return timestamp
+  }
+  return t.In(loc).Format("2006-01-02 15:04:05")
+}
+
+// generateQueryLogTableStart generates the opening of the query log table up to its body
+func generateQueryLogTableStart() string {
+  return `<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
+    <thead>
+      <tr>
+        <th>Time</th>
+        <th>Client</th>
+        <th>Domain</th>
+        <th>Type</th>
+        <th>Result</th>
+        <th>Upstream</th>
+        <th style="text-align: right;">Elapsed</th>
+      </tr>
+    </thead>
+    <tbody>`
+}
+
+// generateQueryLogRow generates one query log table row, highlighting blocked queries
+func generateQueryLogRow(entry QueryLogEntry, loc *time.Location, anonymize bool) string {
+  rowClass, result := "", "Allowed"
+  if isBlockedQuery(entry) {
+    rowClass, result = ` class="blocked-row"`, "Blocked"
+  }
+
+  return fmt.Sprintf(`
+      <tr%s>
+        <td>%s</td>
+        <td>%s%s</td>
+        <td>%s%s</td>
+        <td>%s</td>
+        <td title="%s">%s</td>
+        <td>%s</td>
+        <td style="text-align: right;">%s ms</td>
+      </tr>`,
+    rowClass,
+    template.HTMLEscapeString(formatQueryTime(entry.Time, loc)),
+    template.HTMLEscapeString(shownIP(entry.Client, anonymize)),
+    copyButton(shownIP(entry.Client, anonymize)),
+    template.HTMLEscapeString(entry.Question.Name),
+    copyButton(entry.Question.Name),
+    template.HTMLEscapeString(entry.Question.Type),
+    template.HTMLEscapeString(entry.Reason),
+    result,
+    template.HTMLEscapeString(entry.Upstream),
+    template.HTMLEscapeString(entry.ElapsedMs),
+  )
+}
+
+// generateQueryLogHeader generates the query log page heading with the search/blocked filter form
+func generateQueryLogHeader(query url.Values, limit int) string {
+  path := appURL("/querylog")
+
+  checked := ""
+  if query.Get("blocked") == "true" {
+    checked = " checked"
+  }
+  limitField := ""
+  if query.Get("limit") != "" {
+    limitField = fmt.Sprintf(`<input type="hidden" name="limit" value="%d">`, limit)
+  }
+
+  return fmt.Sprintf(`<div class="header-section">
+    <h1>Query Log</h1>
+    <form class="filter-form" method="GET" action="%s">
+        <input type="search" name="search" value="%s" placeholder="Domain or client">
+        <label><input type="checkbox" name="blocked" value="true"%s> Blocked only</label>
+        %s
+        <button type="submit">Filter</button>
+    </form>
+</div>`,
+    template.HTMLEscapeString(path),
+    template.HTMLEscapeString(query.Get("search")),
+    checked,
+    limitField,
+  )
+}
+
+// generateQueryLogNav generates the cursor links to the newest and to older query log entries
+func generateQueryLogNav(query url.Values, count, limit int, oldest string) string {
+  path := appURL("/querylog")
+
+  var sb strings.Builder
+  sb.WriteString(`<div class="page-nav">`)
+  if query.Get("older_than") != "" {
+    sb.WriteString(fmt.Sprintf(`<a href="%s">&laquo; Newest</a>`, withQuery(path, query, "older_than", "")))
+  }
+  if count >= limit && oldest != "" {
+    sb.WriteString(fmt.Sprintf(`<a href="%s">Older &rsaquo;</a>`, withQuery(path, query, "older_than", oldest)))
+  }
+  sb.WriteString(`</div>`)
+  return sb.String()
+}
+
+// generateStatsContent generates the stats page content
+func generateStatsContent(period string, numDNSQueries int, seriesTotal string, numBlockedFiltering int, avgProcessingTime float64, comparison, topDomainsTable, topClientsTable, topBlockedTable, blockedClientsTable, queryTypesTable, controls string) string {
+  return fmt.Sprintf(`<div class="header-section">
+    <h1>DNS Statistics</h1>
+    %s
+</div>
+
+<div class="summary">
+    <p><strong>Time Period:</strong> %s</p>
+    <p><strong>Total DNS Queries:</strong> %s</p>
+    %s
+    <p><strong>Total Blocked Queries:</strong> %s</p>
+    <p><strong>Average Processing Time:</strong> %s seconds</p>
+</div>
+
+%s
+%s
+%s
+%s
+%s
+%s`, controls, template.HTMLEscapeString(period), formatCount(numDNSQueries), seriesTotal, formatCount(numBlockedFiltering), formatDecimal(avgProcessingTime, 6), comparison, topDomainsTable, topClientsTable, topBlockedTable, blockedClientsTable, queryTypesTable)
+}
+
+// QueryReconciliation compares the total number of queries with the sum of the query series
+type QueryReconciliation struct {
+  Total       int
+  SeriesSum   int
+  DiffPercent float64 // difference as a percentage of the total
+  Mismatch    bool    // the difference is above the threshold
+}
+
+// reconcileQueries sums the query series and compares it with the total, flagging a difference
+// of more than threshold percent. It reports false when there is no series to compare.
+func reconcileQueries(stats *StatsResponse, threshold float64) (QueryReconciliation, bool) {
+  if len(stats.DNSQueries) == 0 {
+    return QueryReconciliation{}, false
+  }
+
+  r := QueryReconciliation{Total: stats.NumDNSQueries}
+  for _, count := range stats.DNSQueries {
+    r.SeriesSum += count
+  }
+
+  diff := r.SeriesSum - r.Total
+  if diff < 0 {
+    diff = -diff
+  }
+  // Queries in the series but none in the total count as entirely different
+  switch {
+  case r.Total > 0:
+    r.DiffPercent = percentOf(diff, r.Total)
+  case diff > 0:
+    r.DiffPercent = 100
+  }
+  r.Mismatch = r.DiffPercent > threshold
+  return r, true
+}
+
+// generateQueryReconciliation generates the stats summary line with the sum of the query series,
+// warning when it doesn't match the total, or nothing without a series
+func generateQueryReconciliation(r QueryReconciliation, ok bool) string {
+  if !ok {
+    return ""
+  }
+  if !r.Mismatch {
+    return fmt.Sprintf(`<p><strong>Sum of Query Series:</strong> %s</p>`, formatCount(r.SeriesSum))
+  }
+  return fmt.Sprintf(`<p class="stats-mismatch"><strong>Sum of Query Series:</strong> %s ⚠ differs from the total by %s%%, check the statistics settings in AdGuard Home</p>`,
+    formatCount(r.SeriesSum),
+    formatDecimal(r.DiffPercent, 1),
+  )
+}
+
+// formatStatsRange formats a chosen stats window in loc, e.g. "2026-10-01 00:00 – 2026-10-02 00:00 UTC"
+func formatStatsRange(rng *StatsRange, loc *time.Location) string {
+  return rng.From.In(loc).Format("2006-01-02 15:04") + " – " + rng.To.In(loc).Format("2006-01-02 15:04 MST")
+}
+
+// generateStatsRangeForm generates the /stats time range form, keeping the other query parameters
+func generateStatsRangeForm(query url.Values, rng *StatsRange, loc *time.Location) string {
+  path := appURL("/stats")
+
+  var hidden strings.Builder
+  for _, key := range []string{"top", "compare"} {
+    if value := query.Get(key); value != "" {
+      hidden.WriteString(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, key, template.HTMLEscapeString(value)))
+    }
+  }
+
+  from, to, clear := "", "", ""
+  if rng != nil {
+    from = rng.From.In(loc).Format("2006-01-02T15:04")
+    to = rng.To.In(loc).Format("2006-01-02T15:04")
+    defaults := copyQuery(query)
+    defaults.Del("to")
+    clear = fmt.Sprintf(`<a href="%s">Default window</a>`, withQuery(path, defaults, "from", ""))
+  }
+
+  return fmt.Sprintf(`<form class="filter-form" method="GET" action="%s">
+        <label>From <input type="datetime-local" name="from" value="%s"></label>
+        <label>To <input type="datetime-local" name="to" value="%s"></label>
+        %s
+        <button type="submit">Show</button>
+        %s
+    </form>`,
+    template.HTMLEscapeString(path),
+    from,
+    to,
+    hidden.String(),
+    clear,
+  )
+}
+
+// PeriodComparison holds the totals of two consecutive days
+type PeriodComparison struct {
+  Queries     int
+  Blocked     int
+  PrevQueries int
+  PrevBlocked int
+  Ranged      bool // the days are today and yesterday, fetched as stats ranges
+}
+
+// comparePreviousDay compares today so far with yesterday, midnight to midnight in the configured
+// timezone, fetching each day as a stats range. When AdGuard Home can't return stats for a range it
+// falls back to comparePeriods on stats, the series already shown; the error is why, if any.
+func comparePreviousDay(ctx context.Context, config *Config, stats *StatsResponse, now time.Time) (PeriodComparison, bool, error) {
+  now = now.In(config.timezone())
+  midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+  yesterday := &StatsRange{From: midnight.AddDate(0, 0, -1), To: midnight}
+  today := &StatsRange{From: midnight, To: now}
+
+  var previous, latest *StatsResponse
+  var previousCovered, latestCovered bool
+  err := fetchConcurrently(
+    func() (err error) {
+      previous, _, previousCovered, err = getStatsInRange(ctx, config, yesterday)
+      return err
+    },
+    func() (err error) {
+      latest, _, latestCovered, err = getStatsInRange(ctx, config, today)
+      return err
+    },
+  )
+  if err != nil || !previousCovered || !latestCovered {
+    cmp, ok := comparePeriods(stats)
+    return cmp, ok, err
+  }
+
+  return PeriodComparison{
+    Queries:     latest.NumDNSQueries,
+    Blocked:     latest.NumBlockedFiltering,
+    PrevQueries: previous.NumDNSQueries,
+    PrevBlocked: previous.NumBlockedFiltering,
+    Ranged:      true,
+  }, true, nil
+}
+
+// comparePeriods takes the last two days of the stats series already shown, for AdGuard Home
+// versions that can't be asked for a window. The latest day is still in progress when the series
+// ends now. It reports false for hourly statistics (a single day) or when there is no previous day yet.
+func comparePeriods(stats *StatsResponse) (PeriodComparison, bool) {
+  n := len(stats.DNSQueries)
+  if stats.TimeUnits != "days" || n < 2 || len(stats.BlockedFiltering) != n {
+    return PeriodComparison{}, false
+  }
+  // The series is ordered oldest first and ends with the current day
+  return PeriodComparison{
+    Queries:     stats.DNSQueries[n-1],
+    Blocked:     stats.BlockedFiltering[n-1],
+    PrevQueries: stats.DNSQueries[n-2],
+    PrevBlocked: stats.BlockedFiltering[n-2],
+  }, true
+}
+
+// formatChange formats the difference between current and previous as "+12 (+3.4%)"
+func formatChange(current, previous int) string {
+  delta := signed(formatCount(current - previous))
+  if previous == 0 {
+    // No previous data means a percentage change is meaningless
+    return delta
+  }
+  return fmt.Sprintf("%s (%s%%)", delta, signed(formatDecimal(float64(current-previous)/float64(previous)*100, 1)))
+}
+
+// signed prefixes a formatted number with "+" unless it is negative
+func signed(formatted string) string {
+  if strings.HasPrefix(formatted, "-") {
+    return formatted
+  }
+  return "+" + formatted
+}
+
+// generateComparisonTable generates the today vs yesterday table for ?compare=previous, labelled
+// as the last two days of the series when they weren't fetched as ranges, or a notice when there
+// is no previous day
+func generateComparisonTable(cmp PeriodComparison, ok bool) string {
+  if !ok {
+    return `<div class="summary"><p>Comparison with the previous day needs AdGuard Home to return stats for a time range, or daily statistics with at least two days of history. ` +
+      `This AdGuard Home only reports its configured statistics interval, so increase its statistics retention beyond 24 hours to compare days.</p></div>`
+  }
+
+  title, latest, previous := "Latest Day vs Previous Day", "Latest Day", "Previous Day"
+  note := "The last two days of the daily statistics above; the latest day may still be in progress."
+  if cmp.Ranged {
+    title, latest, previous = "Today vs Yesterday", "Today", "Yesterday"
+    note = "Today so far and all of yesterday, from midnight."
+  }
+
+  previousBlockedPercent := "-"
+  blockedPercentChange := "-"
+  if cmp.PrevQueries > 0 {
+    previousBlockedPercent = formatDecimal(percentOf(cmp.PrevBlocked, cmp.PrevQueries), 2) + "%"
+    blockedPercentChange = signed(formatDecimal(percentOf(cmp.Blocked, cmp.Queries)-percentOf(cmp.PrevBlocked, cmp.PrevQueries), 2)) + " pts"
+  }
+
+  return fmt.Sprintf(`<h3>%s</h3>
+<p class="truncated-notice">%s</p>
+<div class="table-container">
+<table>
+    <tr><th>Metric</th><th>%s</th><th>%s</th><th>Change</th></tr>
+    <tr><td>DNS Queries</td><td>%s</td><td>%s</td><td>%s</td></tr>
+    <tr><td>Blocked Queries</td><td>%s</td><td>%s</td><td>%s</td></tr>
+    <tr><td>Blocked %%</td><td>%s%%</td><td>%s</td><td>%s</td></tr>
+</table>
+</div>`,
+    title, note, latest, previous,
+    formatCount(cmp.Queries), formatCount(cmp.PrevQueries), formatChange(cmp.Queries, cmp.PrevQueries),
+    formatCount(cmp.Blocked), formatCount(cmp.PrevBlocked), formatChange(cmp.Blocked, cmp.PrevBlocked),
+    formatDecimal(percentOf(cmp.Blocked, cmp.Queries), 2), previousBlockedPercent, blockedPercentChange,
+  )
+}
+
+// generateQueryTypesTable generates the query type breakdown table, or nothing when no types were sampled
+func generateQueryTypesTable(counts map[string]int, sampled, maxRows int) string {
+  if len(counts) == 0 {
+    return ""
+  }
+
+  types := make([]string, 0, len(counts))
+  for queryType := range counts {
+    types = append(types, queryType)
+  }
+  sort.Slice(types, func(i, j int) bool {
+    if counts[types[i]] != counts[types[j]] {
+      return counts[types[i]] > counts[types[j]]
+    }
+    return types[i] < types[j]
+  })
+
+  // Same shape as the AdGuard Home top lists so the table matches the others
+  data := make([]map[string]int, len(types))
+  for i, queryType := range types {
+    data[i] = map[string]int{queryType: counts[queryType]}
+  }
+
+  return generateStatsTable(fmt.Sprintf("Query Types (last %d queries)", sampled), data, "Count", len(data), maxRows)
+}
+
+// generateSkippedFieldsNotice generates a notice naming stats fields that could not be read, or
+// nothing when every field was decoded
+func generateSkippedFieldsNotice(skipped []string) string {
+  if len(skipped) == 0 {
+    return ""
+  }
+  return fmt.Sprintf(`<div class="summary"><p>Some statistics from this AdGuard Home version could not be read and are left out: %s</p></div>`,
+    template.HTMLEscapeString(strings.Join(skipped, ", ")))
+}
+
+// generateBlockedClientsTable generates the "Most Blocked Clients" table, or nothing when the
+// query log had no blocked queries to sample
+func generateBlockedClientsTable(data []map[string]int, sampled, limit, maxRows int) string {
+  if sampled == 0 {
+    return ""
+  }
+  return generateStatsTable(fmt.Sprintf("Most Blocked Clients (last %d blocked queries)", sampled), data, "Blocked", limit, maxRows)
+}
+
+// generateActionForm generates a CSRF protected POST button that asks for confirmation before
+// submitting, sending fields as hidden inputs
+func generateActionForm(action, csrfToken, label, confirmation string, fields url.Values) string {
+  var hidden strings.Builder
+  for _, name := range slices.Sorted(maps.Keys(fields)) {
+    hidden.WriteString(fmt.Sprintf(`
+    <input type="hidden" name="%s" value="%s">`, template.HTMLEscapeString(name), template.HTMLEscapeString(fields.Get(name))))
+  }
+
+  return fmt.Sprintf(`<form class="action-form" method="POST" action="%s" onsubmit="return confirm('%s');">
+    <input type="hidden" name="_csrf" value="%s">%s
+    <button type="submit">%s</button>
+</form>`,
+    template.HTMLEscapeString(action),
+    template.HTMLEscapeString(template.JSEscapeString(confirmation)),
+    template.HTMLEscapeString(csrfToken),
+    hidden.String(),
+    template.HTMLEscapeString(label),
+  )
+}
+
+// generateUpstreamsContent generates the upstreams page content
+func generateUpstreamsContent(upstreamsTable string) string {
+  return fmt.Sprintf(`<div class="header-section">
+    <h1>DNS Upstreams</h1>
+</div>
+
+%s`, upstreamsTable)
+}
+
+// latencyBucketLabels returns the labels of the latency buckets split at bounds, e.g. "<10 ms",
+// "10–50 ms" and "≥200 ms"
+func latencyBucketLabels(bounds []float64) []string {
+  format := func(ms float64) string {
+    return strconv.FormatFloat(ms, 'f', -1, 64)
+  }
+
+  labels := make([]string, 0, len(bounds)+1)
+  for i, bound := range bounds {
+    if i == 0 {
+      labels = append(labels, "<"+format(bound)+" ms")
+    } else {
+      labels = append(labels, format(bounds[i-1])+"–"+format(bound)+" ms")
+    }
+  }
+  return append(labels, "≥"+format(bounds[len(bounds)-1])+" ms")
+}
+
+// generateLatencyHistogram generates the per-upstream latency histogram, a table of bucket counts
+// with a stacked bar per upstream, or nothing when the sample had no upstream timings
+func generateLatencyHistogram(histograms []LatencyHistogram, bounds []float64, sampled, maxRows int) string {
+  if len(histograms) == 0 {
+    return ""
+  }
+
+  labels := latencyBucketLabels(bounds)
+  shown := min(len(histograms), maxRows)
+
+  var sb strings.Builder
+  sb.WriteString(fmt.Sprintf(`<h3>Upstream Latency (last %d queries)</h3>`, sampled))
+  sb.WriteString(`<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
+    <thead>
+      <tr>
+        <th>Upstream</th>`)
+  for _, label := range labels {
+    sb.WriteString(fmt.Sprintf(`
+        <th style="text-align: right;">%s</th>`, template.HTMLEscapeString(label)))
+  }
+  sb.WriteString(`
+        <th>Distribution</th>
+      </tr>
+    </thead>
+    <tbody>`)
+
+  for _, histogram := range histograms[:shown] {
+    sb.WriteString(fmt.Sprintf(`
+        <tr>
+          <td>%s</td>`, template.HTMLEscapeString(histogram.Upstream)))
+    for _, count := range histogram.Counts {
+      sb.WriteString(fmt.Sprintf(`
+          <td style="text-align: right;">%s</td>`, formatCount(count)))
+    }
+
+    // Buckets shade from green (fastest) to red (slowest)
+    sb.WriteString(`
+          <td><div class="latency-bar">`)
+    for i, count := range histogram.Counts {
+      if count == 0 {
+        continue
+      }
+      share := percentOf(count, histogram.Total)
+      sb.WriteString(fmt.Sprintf(`<span style="width: %.2f%%; background-color: hsl(%d, 60%%, 50%%);" title="%s: %d (%.1f%%)"></span>`,
+        share, 120-120*i/len(bounds), template.HTMLEscapeString(labels[i]), count, share))
+    }
+    sb.WriteString(`</div></td>
+        </tr>`)
+  }
+
+  sb.WriteString(`</tbody></table></div>`)
+  sb.WriteString(generateTruncatedNotice(shown, len(histograms)))
+  return sb.String()
+}
+
+// statusLabel renders a boolean as a colored on/off label
+func statusLabel(value bool, yes, no string) string {
+  if value {
+    return `<span class="status-on">` + yes + `</span>`
+  }
+  return `<span class="status-off">` + no + `</span>`
+}
+
+// generateStatusContent generates the AdGuard Home status page content
+func generateStatusContent(config *Config, status *StatusResponse) string {
+  addresses := "—"
+  if len(status.DNSAddresses) > 0 {
+    addresses = template.HTMLEscapeString(strings.Join(status.DNSAddresses, ", "))
+  }
+
+  return fmt.Sprintf(`<div class="header-section">
+    <h1>AdGuard Home Status</h1>
+    <p>%s</p>
+</div>
+
+<div class="summary">
+    <p><strong>Version:</strong> %s</p>
+    <p><strong>Detected Version:</strong> %s</p>
+    <p><strong>Running:</strong> %s</p>
+    <p><strong>Protection:</strong> %s</p>
+    <p><strong>DHCP:</strong> %s</p>
+    <p><strong>DNS Addresses:</strong> %s</p>
+    <p><strong>DNS Port:</strong> %d</p>
+    <p><strong>Web Interface Port:</strong> %d</p>
+</div>`,
+    template.HTMLEscapeString(config.AdGuard.ServerURL),
+    template.HTMLEscapeString(status.Version),
+    template.HTMLEscapeString(detectedVersion().String()),
+    statusLabel(status.Running, "Running", "Stopped"),
+    statusLabel(status.ProtectionEnabled, "Enabled", "Disabled"),
+    statusLabel(status.DHCPAvailable, "Available", "Unavailable"),
+    addresses,
+    status.DNSPort,
+    status.HTTPPort,
+  )
+}
+
+// generateRewritesContent generates the rewrites page content; action is empty when changes are
+// not allowed (server.read_only)
+func generateRewritesContent(rewrites []Rewrite, action, csrfToken string, maxRows int) string {
+  var sb strings.Builder
+
+  sb.WriteString(`<div class="header-section">
+    <h1>DNS Rewrites</h1>
+</div>
+`)
+
+  if action != "" {
+    sb.WriteString(fmt.Sprintf(`<form class="filter-form" method="POST" action="%s" onsubmit="return confirm('Add this DNS rewrite?');">
+    <input type="hidden" name="_csrf" value="%s">
+    <input type="search" name="domain" placeholder="Domain, e.g. *.example.org" required>
+    <input type="search" name="answer" placeholder="IP address or domain" required>
+    <button type="submit">Add Rewrite</button>
+</form>
+`, template.HTMLEscapeString(action+"/add"), template.HTMLEscapeString(csrfToken)))
+  }
+
+  columns := 2
+  actionHeader := ""
+  if action != "" {
+    columns = 3
+    actionHeader = `
+        <th></th>`
+  }
+
+  shown := min(len(rewrites), maxRows)
+
+  sb.WriteString(`<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
+    <thead>
+      <tr>
+        <th>Domain</th>
+        <th>Answer</th>` + actionHeader + `
+      </tr>
+    </thead>
+    <tbody>`)
+
+  if len(rewrites) == 0 {
+    sb.WriteString(emptyTableRow(columns))
+  }
+
+  for _, rewrite := range rewrites[:shown] {
+    remove := ""
+    if action != "" {
+      remove = `
+          <td>` + generateActionForm(action+"/delete", csrfToken, "Delete",
+        fmt.Sprintf("Delete the rewrite %s → %s?", rewrite.Domain, rewrite.Answer),
+        url.Values{"domain": {rewrite.Domain}, "answer": {rewrite.Answer}}) + `</td>`
+    }
+
+    sb.WriteString(fmt.Sprintf(`
+        <tr>
+          <td>%s</td>
+          <td>%s</td>%s
+        </tr>`,
+      template.HTMLEscapeString(rewrite.Domain),
+      template.HTMLEscapeString(rewrite.Answer),
+      remove,
+    ))
+  }
+
+  sb.WriteString(`</tbody></table></div>`)
+  sb.WriteString(generateTruncatedNotice(shown, len(rewrites)))
+  return sb.String()
+}
+
+// generateAccessContent generates the access control page content; action is empty when changes
+// are not allowed (server.read_only)
+func generateAccessContent(accessList *AccessList, action, csrfToken string, maxRows int) string {
+  var sb strings.Builder
+
+  sb.WriteString(`<div class="header-section">
+    <h1>Access Control</h1>
+</div>
+`)
+  sb.WriteString(generateAccessTable("Allowed Clients", "Client", accessList.AllowedClients, maxRows))
+  sb.WriteString(generateAccessTable("Disallowed Clients", "Client", accessList.DisallowedClients, maxRows))
+  sb.WriteString(generateAccessTable("Blocked Hosts", "Host", accessList.BlockedHosts, maxRows))
+
+  if action != "" {
+    textarea := func(name, label, hint string, entries []string) string {
+      return fmt.Sprintf(`
+    <label><strong>%s</strong> <span class="hint">%s</span>
+        <textarea name="%s" rows="6">%s</textarea>
+    </label>`, label, hint, name, template.HTMLEscapeString(strings.Join(entries, "\n")))
+    }
+
+    sb.WriteString(fmt.Sprintf(`<h3>Edit Access Settings</h3>
+<form class="access-form" method="POST" action="%s" onsubmit="return confirm('Replace the AdGuard Home access settings?');">
+    <input type="hidden" name="_csrf" value="%s">%s%s%s
+    <button type="submit">Save</button>
+</form>`,
+      template.HTMLEscapeString(action),
+      template.HTMLEscapeString(csrfToken),
+      textarea("allowed_clients", "Allowed Clients", "One IP, CIDR range or ClientID per line; when set, everyone else is refused", accessList.AllowedClients),
+      textarea("disallowed_clients", "Disallowed Clients", "One IP, CIDR range or ClientID per line", accessList.DisallowedClients),
+      textarea("blocked_hosts", "Blocked Hosts", "One domain per line", accessList.BlockedHosts),
+    ))
+  }
+
+  return sb.String()
+}
+
+// generateAccessTable generates a single column table for one access list
+func generateAccessTable(title, header string, entries []string, maxRows int) string {
+  var sb strings.Builder
+
+  shown := min(len(entries), maxRows)
+
+  sb.WriteString(fmt.Sprintf(`<h3>%s</h3>`, title))
+  sb.WriteString(`<div class="table-container"><table>
+    <thead>
+      <tr>
+        <th>` + header + `</th>
+      </tr>
+    </thead>
+    <tbody>`)
+
+  if len(entries) == 0 {
+    sb.WriteString(`
+      <tr>
+        <td class="empty-row">No entries</td>
+      </tr>`)
+  }
+
+  for _, entry := range entries[:shown] {
+    sb.WriteString(`
+      <tr>
+        <td>` + template.HTMLEscapeString(entry) + `</td>
+      </tr>`)
+  }
+
+  sb.WriteString(`</tbody></table></div>`)
+  sb.WriteString(generateTruncatedNotice(shown, len(entries)))
+  return sb.String()
+}
+
+// accessEntries splits a textarea into trimmed, non-empty lines
+func accessEntries(value string) []string {
+  entries := []string{}
+  for _, line := range strings.Split(value, "\n") {
+    if line = strings.TrimSpace(line); line != "" {
+      entries = append(entries, line)
+    }
+  }
+  return entries
+}
+
+// generateFilteringContent generates the filtering page content with the blocklists and allowlists
+func generateFilteringContent(status *FilteringStatus, loc *time.Location, toggleAction, csrfToken, controls string, maxRows int) string {
+  return fmt.Sprintf(`<div class="header-section">
+    <h1>Filtering</h1>
+    %s
+</div>
+
+<div class="summary">
+    <p><strong>Filtering:</strong> %s</p>
+    <p><strong>List Update Interval:</strong> %s</p>
+</div>
+
+%s
+%s`,
+    controls,
+    statusLabel(status.Enabled, "Enabled", "Disabled"),
+    formatUpdateInterval(status.Interval),
+    generateFiltersTable("Blocklists", status.Filters, false, loc, toggleAction, csrfToken, maxRows),
+    generateFiltersTable("Allowlists", status.WhitelistFilters, true, loc, toggleAction, csrfToken, maxRows),
+  )
+}
+
+// formatUpdateInterval formats the filter update interval in hours, 0 meaning never
+func formatUpdateInterval(hours int) string {
+  switch {
+  case hours == 0:
+    return "Never"
+  case hours == 24:
+    return "1 day"
+  case hours%24 == 0:
+    return fmt.Sprintf("%d days", hours/24)
+  case hours == 1:
+    return "1 hour"
+  default:
+    return fmt.Sprintf("%d hours", hours)
+  }
+}
+
+// generateFiltersTable generates a table of filter lists; toggleAction is empty when changes are
+// not allowed (server.read_only)
+func generateFiltersTable(title string, filters []Filter, whitelist bool, loc *time.Location, toggleAction, csrfToken string, maxRows int) string {
+  var sb strings.Builder
+
+  shown := min(len(filters), maxRows)
+
+  sb.WriteString(fmt.Sprintf(`<h3>%s</h3>`, title))
+  sb.WriteString(`<div class="table-container"><div class="mobile-table-info">Swipe horizontally to view all columns</div><table>
+    <thead>
+      <tr>
+        <th>Name</th>
+        <th>URL</th>
+        <th style="text-align: right;">Rules</th>
+        <th>Last Updated</th>
+        <th>Status</th>
+      </tr>
+    </thead>
+    <tbody>`)
+
+  if len(filters) == 0 {
+    sb.WriteString(emptyTableRow(5))
+  }
+
+  for _, filter := range filters[:shown] {
+    name := "—"
+    if filter.Name != "" {
+      name = filter.Name
+    }
+    lastUpdated := "—"
+    if filter.LastUpdated != "" {
+      lastUpdated = formatQueryTime(filter.LastUpdated, loc)
+    }
+    status := statusLabel(filter.Enabled, "Enabled", "Disabled")
+    if toggleAction != "" {
+      status += " " + generateFilterToggle(toggleAction, csrfToken, filter, whitelist)
+    }
+
+    sb.WriteString(fmt.Sprintf(`
+        <tr>
+          <td>%s</td>
+          <td>%s</td>
+          <td style="text-align: right;">%s</td>
+          <td>%s</td>
+          <td>%s</td>
+        </tr>`,
+      template.HTMLEscapeString(name),
+      template.HTMLEscapeString(filter.URL),
+      formatCount(filter.RulesCount),
+      template.HTMLEscapeString(lastUpdated),
+      status,
+    ))
+  }
+
+  sb.WriteString(`</tbody></table></div>`)
+  sb.WriteString(generateTruncatedNotice(shown, len(filters)))
+  return sb.String()
+}
+
+// displayFilterName returns the list name, or its URL when it has none
+func displayFilterName(filter Filter) string {
+  if filter.Name != "" {
+    return filter.Name
+  }
+  return filter.URL
+}
+
+// generateFilterToggle generates the CSRF protected form that enables or disables one filter list
+func generateFilterToggle(action, csrfToken string, filter Filter, whitelist bool) string {
+  label := "Enable"
+  if filter.Enabled {
+    label = "Disable"
+  }
+  return fmt.Sprintf(`<form class="action-form filter-toggle" method="POST" action="%s">
+    <input type="hidden" name="_csrf" value="%s">
+    <input type="hidden" name="url" value="%s">
+    <input type="hidden" name="whitelist" value="%t">
+    <input type="hidden" name="enabled" value="%t">
+    <button type="submit">%s</button>
+</form>`,
+    template.HTMLEscapeString(action),
+    template.HTMLEscapeString(csrfToken),
+    template.HTMLEscapeString(filter.URL),
+    whitelist,
+    !filter.Enabled,
+    label,
+  )
+}
+
+// flashCookie carries a one-time message across a POST/redirect/GET round trip
+const flashCookie = "aghamon_flash"
+
+// setFlash stores a one-time message of the given kind ("success" or "error") for the next page
+func setFlash(c echo.Context, kind, message string) {
+  c.SetCookie(&http.Cookie{
+    Name:     flashCookie,
+    Value:    url.QueryEscape(kind + ":" + message),
+    Path:     appURL("/"),
+    HttpOnly: true,
+    SameSite: http.SameSiteLaxMode,
+  })
+}
+
+// popFlash returns and clears the pending flash message, if any
+func popFlash(c echo.Context) map[string]string {
+  cookie, err := c.Cookie(flashCookie)
+  if err != nil {
+    return nil
+  }
+  c.SetCookie(&http.Cookie{Name: flashCookie, Path: appURL("/"), MaxAge: -1})
+
+  value, err := url.QueryUnescape(cookie.Value)
+  if err != nil {
+    return nil
+  }
+  kind, message, ok := strings.Cut(value, ":")
+  if !ok || (kind != "success" && kind != "error") {
+    return nil
+  }
+  return map[string]string{"Kind": kind, "Message": message}
+}
+
+// csrfToken returns the CSRF token for the current request, set by the CSRF middleware
+func csrfToken(c echo.Context) string {
+  token, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+  return token
+}
+
+// renderPage renders content inside the base template, titled "<section> - <brand>" or just the brand when section is empty
+func renderPage(c echo.Context, config *Config, code int, section, content string) error {
+  return c.Render(code, "base.html", pageData(c, config, section, content))
+}
+
+// renderPrintReport renders stats content with the standalone print.html template, headed by
+// the period the stats cover (rng when one was chosen) and when the report was generated
+func renderPrintReport(c echo.Context, config *Config, stats *StatsResponse, fetchedAt time.Time, rng *StatsRange, content string) error {
+  loc := config.timezone()
+  start, end := statsPeriod(stats, fetchedAt)
+  if rng != nil {
+    start, end = rng.From, rng.To
+  }
+
+  return c.Render(http.StatusOK, "print.html", map[string]interface{}{
+    "Title": "DNS Statistics Report - " + config.brandTitle(),
+    "Brand": config.brandTitle(),
+    "PeriodStart": start.In(loc).Format("2006-01-02 15:04 MST"),
+    "PeriodEnd": end.In(loc).Format("2006-01-02 15:04 MST"),
+    "GeneratedAt": time.Now().In(loc).Format("2006-01-02 15:04:05 MST"),
+    "Version": version,
+    "NoIndex": !config.Server.AllowIndexing,
+    "Content": template.HTML(content),
+  })
+}
+
+// statsPeriod returns the time range covered by the stats, one time unit per dns_queries entry
+func statsPeriod(stats *StatsResponse, fetchedAt time.Time) (time.Time, time.Time) {
+  unit := time.Hour
+  if stats.TimeUnits == "days" {
+    unit = 24 * time.Hour
+  }
+  return fetchedAt.Add(-time.Duration(statsPeriodUnits(stats)) * unit), fetchedAt
+}
+
+// statsPeriodUnits returns how many time units the stats cover, one per dns_queries entry, or 24
+// when AdGuard Home sent no series
+func statsPeriodUnits(stats *StatsResponse) int {
+  if len(stats.DNSQueries) == 0 {
+    return 24
+  }
+  return len(stats.DNSQueries)
+}
+
+// periodUnit returns the stats time unit ("hours" or "days" from AdGuard Home, hours when unset)
+// in the singular or plural for n
+func periodUnit(n int, units string) string {
+  unit := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(units)), "s")
+  if unit == "" {
+    unit = "hour"
+  }
+  if n == 1 {
+    return unit
+  }
+  return unit + "s"
+}
+
+// formatStatsPeriod formats the length of the window the stats cover, e.g. "24 hours", "7 days"
+// or "1 hour", for labels such as "Last 24 hours"
+func formatStatsPeriod(stats *StatsResponse) string {
+  n := statsPeriodUnits(stats)
+  return formatCount(n) + " " + periodUnit(n, stats.TimeUnits)
+}
+
+// prefersJSON reports whether the Accept header ranks application/json above text/html, so a page
+// route can serve the same data to scripts as JSON. Browsers ask for HTML, and an empty Accept
+// header keeps the page.
+func prefersJSON(r *http.Request) bool {
+  jsonQ, htmlQ := -1.0, -1.0
+  for _, part := range strings.Split(r.Header.Get(echo.HeaderAccept), ",") {
+    mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+    q := 1.0
+    for _, param := range strings.Split(params, ";") {
+      if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+        if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+          q = parsed
+        }
+      }
+    }
+    switch strings.ToLower(strings.TrimSpace(mediaType)) {
+    case echo.MIMEApplicationJSON:
+      jsonQ = max(jsonQ, q)
+    case "text/html":
+      htmlQ = max(htmlQ, q)
+    }
+  }
+  return jsonQ > 0 && jsonQ > htmlQ
+}
+
+// negotiateJSON reports whether to answer with JSON instead of the page, marking the response as
+// varying by Accept so caches keep both
+func negotiateJSON(c echo.Context) bool {
+  c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+  return prefersJSON(c.Request())
+}
+
+// pageData returns the base.html template data for a page
+func pageData(c echo.Context, config *Config, section, content string) map[string]interface{} {
+  title := config.brandTitle()
+  if section != "" {
+    title = section + " - " + title
+  }
+
+  // Link previews use the section description and need absolute URLs
+  description := sectionFor("/").Description
+  for _, s := range sections {
+    if s.Title != "" && s.Title == section {
+      description = s.Description
+    }
+  }
+  origin := c.Scheme() + "://" + c.Request().Host
+  image := config.brandLogoURL()
+  if strings.HasPrefix(image, "/") {
+    image = origin + image
+  }
+  // The page URL can name a client (/clients/:ip, a search), so it is left out when IPs are masked
+  pageURL := origin + c.Request().URL.RequestURI()
+  if anonymizeRequested(c, config) {
+    pageURL = ""
+  }
+
+  return map[string]interface{}{
+    "Title": title,
+    "Brand": config.brandTitle(),
+    "LogoURL": config.brandLogoURL(),
+    "Sections": sections,
+    "Description": description,
+    "PageURL": pageURL,
+    "ImageURL": image,
+    "Flash": popFlash(c),
+    "Protection": protectionBadge(c, config),
+    "Theme": config.theme(),
+    "Version": version,
+    "BasePath": config.basePath(),
+    "NoIndex": !config.Server.AllowIndexing,
+    "Content": template.HTML(content),
+  }
+}
+
+// streamMarker stands in for the page content while base.html is split around it
+const streamMarker = "<!--aghamon:content-->"
+
+// streamPage writes base.html around content produced by write, sending the page head first so
+// large pages reach the browser while the content is still being generated. Errors from write
+// can no longer change the status code, so they are only logged.
+func streamPage(c echo.Context, config *Config, code int, section string, write func(w io.Writer) error) error {
+  // Without an echo context the renderer sets no Server-Timing header: it would only cover the
+  // page head, as the rows are fetched and written after the headers are sent
+  var buf bytes.Buffer
+  if err := c.Echo().Renderer.Render(&buf, "base.html", pageData(c, config, section, streamMarker), nil); err != nil {
+    return err
+  }
+  head, tail, _ := strings.Cut(buf.String(), streamMarker)
+
+  res := c.Response()
+  res.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+  res.WriteHeader(code)
+  if _, err := io.WriteString(res, head); err != nil {
+    return nil // the client went away
+  }
+  res.Flush()
+
+  if err := write(res); err != nil {
+    c.Logger().Error("streaming ", section, ": ", err)
+  }
+
+  io.WriteString(res, tail)
+  return nil
+}
+
+// wsUpgrader upgrades /ws/stats requests; the default origin check only allows same-origin pages
+var wsUpgrader = websocket.Upgrader{}
+
+// newLiveStatsHandler returns a handler that pushes stats summaries over a WebSocket on the configured interval
+func newLiveStatsHandler(config *Config) echo.HandlerFunc {
+  var connections int32
+  interval := time.Duration(config.Server.LiveUpdates.Interval) * time.Second
+  maxConnections := int32(config.Server.LiveUpdates.MaxConnections)
+
+  return func(c echo.Context) error {
+    if atomic.AddInt32(&connections, 1) > maxConnections {
+      atomic.AddInt32(&connections, -1)
+      return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many live update connections")
+    }
+    defer atomic.AddInt32(&connections, -1)
+
+    conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
+    if err != nil {
+      return nil // the upgrader has already replied
+    }
+    defer conn.Close()
+
+    // Read (and discard) client messages so close frames and disconnects are noticed
+    done := make(chan struct{})
+    go func() {
+      defer close(done)
+      for {
+        if _, _, err := conn.ReadMessage(); err != nil {
+          return
+        }
+      }
+    }()
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+      // Reusing entries up to one interval old means N viewers share one fetch per interval
+      statsResponse, fetchedAt, err := getStatsMaxAge(c.Request().Context(), currentConfig(), interval)
+      if err != nil {
+        c.Logger().Warn("live stats: ", err)
+      } else {
+        conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+        if err := conn.WriteJSON(summarizeStats(statsResponse, fetchedAt)); err != nil {
+          return nil
+        }
+      }
+
+      select {
+      case <-done:
+        return nil
+      case <-ticker.C:
+      }
+    }
+  }
+}
+
+// readOnlyMiddleware rejects mutating requests with 403 when the server is read-only
+func readOnlyMiddleware(config *Config) echo.MiddlewareFunc {
+  return func(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+      switch c.Request().Method {
+      case http.MethodGet, http.MethodHead, http.MethodOptions:
+        return next(c)
+      }
+      if config.readOnly() {
+        return echo.NewHTTPError(http.StatusForbidden, "Aghamon is running in read-only mode")
+      }
+      return next(c)
+    }
+  }
+}
+
+// newHTTPErrorHandler returns an echo.HTTPErrorHandler that renders the error template
+func newHTTPErrorHandler(t *Template) echo.HTTPErrorHandler {
+  return func(err error, c echo.Context) {
+    if c.Response().Committed {
+      return
+    }
+
+    config := currentConfig()
+
+    code := http.StatusInternalServerError
+    message := "Something went wrong while handling your request."
+    detail := ""
+
+    var he *echo.HTTPError
+    if errors.As(err, &he) {
+      code = he.Code
+      if m, ok := he.Message.(string); ok {
+        message = m
+      }
+      if he.Internal != nil {
+        detail = he.Internal.Error()
+      }
+    } else {
+      detail = err.Error()
+    }
+
+    // Fail-fast errors from the circuit breaker get their own message, and every error meaning
+    // AdGuard Home is unreachable a 503 with a Retry-After hint
+    var open *circuitOpenError
+    if errors.As(err, &open) {
+      message = open.Error() + "."
+    }
+    retryIn, unreachable := adguardUnreachable(err)
+    if unreachable {
+      code = http.StatusServiceUnavailable
+      c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryIn.Seconds()))))
+    }
+
+    if code >= http.StatusInternalServerError {
+      c.Logger().Error(err)
+    }
+
+    // Raw upstream errors are only shown when debugging
+    if !config.debug() {
+      detail = ""
+    }
+
+    if c.Request().Method == http.MethodHead {
+      c.NoContent(code)
+      return
+    }
+
+    // JSON API clients get a JSON error body instead of the error page
+    if strings.HasPrefix(c.Request().URL.Path, config.basePath()+"/api/") || prefersJSON(c.Request()) {
+      body := map[string]interface{}{"error": message}
+      if detail != "" {
+        body["detail"] = detail
+      }
+      if err := c.JSON(code, body); err != nil {
+        c.Logger().Error(err)
+      }
+      return
+    }
+
+    // Pages get the offline page instead, which retries on its own, e.g. on a wall display while
+    // AdGuard Home restarts
+    if unreachable {
+      renderUnavailable(c, t, config, message, detail, retryIn)
+      return
+    }
+
+    var buf bytes.Buffer
+    if err := t.templates.ExecuteTemplate(&buf, "error.html", map[string]interface{}{
+      "Code": code,
+      "StatusText": http.StatusText(code),
+      "Message": message,
+      "Detail": detail,
+      "BasePath": config.basePath(),
+    }); err != nil {
+      c.Logger().Error(err)
+      c.String(code, http.StatusText(code))
+      return
+    }
+
+    if err := renderPage(c, config, code, fmt.Sprintf("%d %s", code, http.StatusText(code)), buf.String()); err != nil {
+      c.Logger().Error(err)
+    }
+  }
+}
+
+// unreachableRetry is how long the offline page waits before retrying when the circuit breaker
+// has not set a cooldown
+const unreachableRetry = 10 * time.Second
+
+// adguardUnreachable reports whether err means AdGuard Home could not be reached: the circuit
+// breaker failing fast, a failed connection or timeout, or a gateway error from a proxy in front
+// of it. It also returns how long to wait before trying again.
+func adguardUnreachable(err error) (time.Duration, bool) {
+  var open *circuitOpenError
+  if errors.As(err, &open) {
+    return open.retryIn, true
+  }
+
+  var statusErr *upstreamStatusError
+  if errors.As(err, &statusErr) {
+    switch statusErr.code {
+    case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+      return unreachableRetry, true
+    }
+    return 0, false
+  }
+
+  // The HTTP client reports transport failures as *url.Error; a canceled request is the browser
+  // going away, not AdGuard Home
+  var urlErr *url.Error
+  if errors.As(err, &urlErr) && !errors.Is(err, context.Canceled) {
+    return unreachableRetry, true
+  }
+  return 0, false
+}
+
+// renderUnavailable renders the AdGuard Home unreachable page with the time of the last cached
+// data and a countdown to an automatic retry. Only GET requests retry, since reloading would
+// repeat any other request.
+func renderUnavailable(c echo.Context, t *Template, config *Config, message, detail string, retryIn time.Duration) {
+  seconds := int(math.Ceil(retryIn.Seconds()))
+  retryURL := ""
+  if c.Request().Method == http.MethodGet {
+    retryURL = c.Request().URL.RequestURI()
+    c.Response().Header().Set("Refresh", strconv.Itoa(seconds))
+  }
+
+  lastGood := ""
+  if fetchedAt := cache.lastFetched("stats", "clients"); !fetchedAt.IsZero() {
+    lastGood = fetchedAt.In(config.timezone()).Format("2006-01-02 15:04:05 MST")
+  }
+
+  var buf bytes.Buffer
+  if err := t.templates.ExecuteTemplate(&buf, "unavailable.html", map[string]interface{}{
+    "Message": message,
+    "Detail": detail,
+    "LastGood": lastGood,
+    "RetryIn": seconds,
+    "RetryURL": retryURL,
+    "BasePath": config.basePath(),
+  }); err != nil {
+    c.Logger().Error(err)
+    c.String(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+    return
+  }
+
+  if err := renderPage(c, config, http.StatusServiceUnavailable, "AdGuard Home Unreachable", buf.String()); err != nil {
+    c.Logger().Error(err)
+  }
+}
+
+// Query log page sizes for the ?limit= parameter
+const (
+  defaultQueryLogLimit = 100
+  maxQueryLogLimit     = 1000
+)
+
+// maxQueryLogExportLimit caps ?limit= on /querylog.ndjson, which pages through AdGuard Home
+// maxQueryLogLimit entries at a time
+const maxQueryLogExportLimit = 100000
+
+// queryLogFilters returns the AdGuard Home query log parameters for the ?search=, ?older_than=
+// and ?blocked=true filters
+func queryLogFilters(c echo.Context) url.Values {
+  params := url.Values{}
+  if search := strings.TrimSpace(c.QueryParam("search")); search != "" {
+    params.Set("search", search)
+  }
+  if olderThan := c.QueryParam("older_than"); olderThan != "" {
+    params.Set("older_than", olderThan)
+  }
+  if c.QueryParam("blocked") == "true" {
+    params.Set("response_status", "blocked")
+  }
+  return params
+}
+
+// queryLogFlushRows is how many streamed query log rows are written between flushes
+const queryLogFlushRows = 50
+
+// staticMaxAge is how long browsers may cache embedded assets, in seconds
+const staticMaxAge = 86400
+
+// assetETags returns a content hash ETag for every embedded asset, keyed by its path. Embedded
+// assets only change with the binary, so the hashes are computed once.
+func assetETags(assets fs.FS) map[string]string {
+  etags := make(map[string]string)
+  fs.WalkDir(assets, ".", func(name string, d fs.DirEntry, err error) error {
+    if err != nil || d.IsDir() {
+      return err
+    }
+    data, err := fs.ReadFile(assets, name)
+    if err != nil {
+      return err
+    }
+    sum := sha256.Sum256(data)
+    etags[name] = `"` + hex.EncodeToString(sum[:16]) + `"`
+    return nil
   })
+  return etags
+}
 
-  e.GET("/stats", func(c echo.Context) error {
-    // Fetch stats from AdGuard Home
-    statsResponse, err := fetchStats(config)
+// bypassCache drops the given cache keys when a page is requested with ?nocache=1, so the handler
+// fetches fresh data from AdGuard Home and caches it again. The parameter is then removed from the
+// request, so links built from the query don't keep bypassing the cache.
+func bypassCache(keys ...string) echo.MiddlewareFunc {
+  return func(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+      query := c.Request().URL.Query()
+      if !query.Has("nocache") {
+        return next(c)
+      }
+
+      if query.Get("nocache") == "1" {
+        cache.invalidate(keys...)
+      }
+      query.Del("nocache")
+      c.Request().URL.RawQuery = query.Encode()
+      return next(c)
+    }
+  }
+}
+
+// staticCacheHeaders sets the ETag and Cache-Control headers for embedded assets. The file is then
+// served with http.ServeContent, which answers If-None-Match from the ETag and handles content
+// types and range requests.
+func staticCacheHeaders(etags map[string]string) echo.MiddlewareFunc {
+  return func(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+      name, err := url.PathUnescape(c.Param("*"))
+      if err != nil || name == "" {
+        name = path.Base(c.Request().URL.Path)
+      }
+      if etag, ok := etags[path.Clean(name)]; ok {
+        c.Response().Header().Set("ETag", etag)
+        c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", staticMaxAge))
+      }
+      return next(c)
+    }
+  }
+}
+
+// registerAssets serves the embedded assets under /static and the favicon. fs.FS rejects paths
+// outside the assets directory.
+func registerAssets(g *echo.Group) {
+  assets := echo.MustSubFS(assetFS, "assets")
+  cacheHeaders := staticCacheHeaders(assetETags(assets))
+  g.Group("/static", cacheHeaders).StaticFS("/", assets)
+  g.FileFS("/favicon.ico", "favicon.ico", assets, cacheHeaders)
+}
+
+func main() {
+  configPath := flag.String("config", "config.yaml", `configuration file, or "-" to read it from stdin`)
+  flag.Parse()
+
+  e := echo.New()
+
+  if missing := append(missingEmbeds(templateFS, requiredTemplates), missingEmbeds(assetFS, requiredAssets)...); len(missing) > 0 {
+    e.Logger.Fatalf("Embedded files missing from this build: %s", strings.Join(missing, ", "))
+  }
+  
+  // Load configuration
+  config, err := loadConfigFile(*configPath)
+  if err != nil {
+    e.Logger.Fatal("Failed to load config:", err)
+  }
+  e.Logger.SetLevel(config.logLevel())
+  activeConfig.Store(config)
+
+  client, err := newHTTPClient(config)
+  if err != nil {
+    e.Logger.Fatal("Failed to create AdGuard Home client:", err)
+  }
+  httpClient.Store(client)
+  if config.AdGuard.InsecureSkipVerify {
+    if config.AdGuard.CACertFile != "" {
+      e.Logger.Warn("adguard.insecure_skip_verify is ignored because adguard.ca_cert_file is set")
+    } else {
+      e.Logger.Warn("adguard.insecure_skip_verify is enabled: TLS certificates from AdGuard Home are NOT verified")
+    }
+  }
+
+  // Surface a wrong URL or credentials now rather than on the first page load
+  if err := checkConnectivity(config); err != nil {
+    e.Logger.Warnf("!!! Could not reach AdGuard Home at %s: %v", config.AdGuard.ServerURL, err)
+    e.Logger.Warn("!!! Aghamon will start anyway; check adguard.server_url, username and password in the configuration")
+  } else {
+    e.Logger.Infof("Connected to AdGuard Home %s at %s", detectedVersion(), config.AdGuard.ServerURL)
+  }
+
+  // Parse embedded templates
+  templates, err := template.ParseFS(templateFS, requiredTemplates...)
+  if err != nil {
+    e.Logger.Fatal("Failed to parse embedded templates:", err)
+  }
+  
+  // Setup template renderer with embedded templates
+  t := &Template{
+    templates: templates,
+  }
+  e.Renderer = t
+  e.HTTPErrorHandler = newHTTPErrorHandler(t)
+
+  // Behind a reverse proxy the client IP comes from X-Forwarded-For, but only from trusted proxies
+  trustedProxies, _ := parseTrustedProxies(config.Server.TrustedProxies) // validated by loadConfig
+  e.IPExtractor = newIPExtractor(trustedProxies)
+
+  // All routes live under server.base_path so Aghamon can be served from a reverse proxy subpath
+  basePath := config.basePath()
+  g := e.Group(basePath)
+
+
+  // Keep search engines from indexing an exposed dashboard unless server.allow_indexing is set
+  e.Use(noIndexMiddleware)
+
+  // Log each request at info level, except the paths in server.log.skip_paths; errors are handled
+  // here so the logged status is the one sent
+  e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+    Skipper: func(c echo.Context) bool {
+      return skipRequestLog(strings.TrimPrefix(c.Request().URL.Path, basePath), currentConfig().logSkipPaths())
+    },
+    HandleError: true,
+    LogMethod:   true,
+    LogURI:      true,
+    LogStatus:   true,
+    LogLatency:  true,
+    LogRemoteIP: true,
+    LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+      c.Logger().Infoj(log.JSON{
+        "method":    v.Method,
+        "uri":       v.URI,
+        "status":    v.Status,
+        "latency":   v.Latency.String(),
+        "remote_ip": v.RemoteIP,
+      })
+      return nil
+    },
+  }))
+
+  // Mutating routes are only registered when server.read_only is false
+  e.Use(readOnlyMiddleware(config))
+  if !config.readOnly() {
+    e.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
+      Skipper: func(c echo.Context) bool {
+        path := c.Request().URL.Path
+        return strings.HasPrefix(path, basePath+"/static/") || strings.HasPrefix(path, basePath+"/api/")
+      },
+      TokenLookup:    "form:_csrf",
+      CookiePath:     basePath + "/",
+      CookieHTTPOnly: true,
+      CookieSameSite: http.SameSiteStrictMode,
+    }))
+  }
+
+  // Rate limit page loads per client IP so bursts never reach AdGuard Home unchecked
+  if limit := config.rateLimit(); limit > 0 {
+    e.Use(middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+      Skipper: func(c echo.Context) bool {
+        path := c.Request().URL.Path
+        return strings.HasPrefix(path, basePath+"/static/") || path == basePath+"/favicon.ico"
+      },
+      Store: middleware.NewRateLimiterMemoryStore(rate.Limit(limit)),
+    }))
+  }
+
+  registerAssets(g)
+  g.GET("/robots.txt", func(c echo.Context) error {
+    return c.String(http.StatusOK, robotsTxt(currentConfig()))
+  })
+
+  if basePath != "" {
+    e.GET(basePath, func(c echo.Context) error {
+      return c.Redirect(http.StatusMovedPermanently, basePath+"/")
+    })
+  }
+
+  g.GET("/", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    // Fetch stats and clients from AdGuard Home in parallel. Each section renders on its own, so
+    // one failed fetch only replaces its own numbers with an error banner.
+    var statsResponse *StatsResponse
+    var clientsResponse *ClientsResponse
+    var statsErr, clientsErr error
+    stop := timeFetch(c)
+    fetchConcurrently(
+      func() error {
+        statsResponse, _, statsErr = getStats(ctx, config)
+        return nil
+      },
+      func() error {
+        clientsResponse, _, clientsErr = getClients(ctx, config)
+        return nil
+      },
+    )
+    stop()
+    if statsErr != nil && clientsErr != nil {
+      return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching data from AdGuard Home").SetInternal(errors.Join(statsErr, clientsErr))
+    }
+
+    clientCount := -1
+    if clientsErr != nil {
+      c.Logger().Warn("home clients: ", clientsErr)
+    } else {
+      clientCount = len(visibleClients(config, clientsResponse))
+    }
+    if statsErr != nil {
+      c.Logger().Warn("home stats: ", statsErr)
+      statsResponse = nil
+    }
+
+    return renderPage(c, config, http.StatusOK, "", generateHomeContent(config.brandTitle(), statsResponse, clientCount, config.Server.LiveUpdates.Interval > 0, config.Server.Links, config.locale()))
+  })
+
+  g.GET("/clients", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    // Fetch clients from AdGuard Home
+    stop := timeFetch(c)
+    clientsResponse, fetchedAt, err := getClients(ctx, config)
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching clients from AdGuard Home").SetInternal(err)
+    }
+
+    // Combine both clients and auto_clients, minus any hidden by the display filters
+    visible := visibleClients(config, clientsResponse)
+    allClients := slices.Clone(visible)
+
+    // Narrow down to configured or auto clients; "all" and unknown values show both
+    clientType := c.QueryParam("type")
+    if _, ok := clientTypeLabels[clientType]; ok {
+      allClients = slices.DeleteFunc(allClients, func(client Client) bool { return client.Type != clientType })
+    } else {
+      clientType = ""
+    }
+
+    // Narrow down to one tag; the filter links offer every tag in use
+    tags := clientTags(allClients)
+    tag := c.QueryParam("tag")
+    if tag != "" {
+      tagged := allClients[:0:0]
+      for _, client := range allClients {
+        if slices.Contains(client.Tags, tag) {
+          tagged = append(tagged, client)
+        }
+      }
+      allClients = tagged
+    }
+
+    // Search by IP or name substring, plus an exact lookup through AdGuard Home's client search
+    search := strings.TrimSpace(c.QueryParam("q"))
+    if search != "" {
+      allClients = filterClients(allClients, search)
+      stop = timeFetch(c)
+      found, err := searchClients(ctx, config, search)
+      stop()
+      if err != nil {
+        c.Logger().Debug("client search: ", err)
+      }
+      for _, client := range found {
+        // Unknown identifiers come back as empty placeholders
+        if client.Name == "" && client.Source == "" {
+          continue
+        }
+        // Known clients keep their type; anything else is a runtime client
+        if known, ok := findClient(visible, client.IP); ok {
+          client.Type = known.Type
+        } else {
+          client.Type = clientTypeAuto
+        }
+        if _, ok := findClient(allClients, client.IP); !ok && clientVisible(config, client) &&
+          (tag == "" || slices.Contains(client.Tags, tag)) && (clientType == "" || clientType == client.Type) {
+          allClients = append(allClients, client)
+        }
+      }
+    }
+
+    sortKey := c.QueryParam("sort")
+    if !sortClients(allClients, sortKey) {
+      sortKey = ""
+    }
+
+    // Scripts asking for JSON get every filtered client, unpaginated, in the /api/clients format
+    if negotiateJSON(c) {
+      if allClients == nil {
+        allClients = []Client{}
+      }
+      if anonymizeRequested(c, config) {
+        allClients = anonymizedClients(allClients)
+      }
+      return c.JSON(http.StatusOK, allClients)
+    }
+
+    // Pinned clients lead the table whatever the sort; the JSON above keeps the plain order
+    pinned := pinnedClientSet(config)
+    pinClients(allClients, pinned)
+
+    // Slice out the requested page
+    page := paginate(
+      len(allClients),
+      queryInt(c, "page", 1, 1, len(allClients)+1),
+      queryInt(c, "per_page", defaultPerPage, 1, maxPerPage),
+    )
+
+    // The queries column needs the top clients from the stats
+    columns := config.clientColumns()
+    var queryCounts map[string]int
+    if slices.Contains(columns, "queries") {
+      stop = timeFetch(c)
+      statsResponse, _, err := getStats(ctx, config)
+      stop()
+      if err != nil {
+        return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching stats from AdGuard Home").SetInternal(err)
+      }
+      queryCounts = topClientCounts(statsResponse)
+    }
+
+    // Generate HTML table
+    cards := c.QueryParam("layout") == "cards"
+    htmlTable := generateHTMLTable(allClients[page.Start:page.End], columns, queryCounts, pinned, config.maxRows(), cards, anonymizeRequested(c, config))
+
+    filters := generateClientSearch(c.QueryParams(), search) + generateTypeFilter(c.QueryParams(), clientType) + generateTagFilter(c.QueryParams(), tags, tag) +
+      generateLayoutToggle(c.QueryParams(), cards)
+    content := generateClientsContent(page, c.QueryParams(), sortKey, filters, htmlTable) + generateLastUpdated(fetchedAt.In(config.timezone()), refreshURL(c))
+
+    return renderPage(c, config, http.StatusOK, sectionFor("/clients").Title, content)
+  }, bypassCache("clients", "stats"))
+
+  g.GET("/clients/:ip", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    id, err := url.PathUnescape(c.Param("ip"))
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadRequest, "Invalid client identifier")
+    }
+
+    var statsResponse *StatsResponse
+    var clientsResponse *ClientsResponse
+    stop := timeFetch(c)
+    err = fetchConcurrently(
+      func() (err error) {
+        statsResponse, _, err = getStats(ctx, config)
+        return err
+      },
+      func() (err error) {
+        clientsResponse, _, err = getClients(ctx, config)
+        return err
+      },
+    )
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching client data from AdGuard Home").SetInternal(err)
+    }
+
+    client, ok := findClient(visibleClients(config, clientsResponse), id)
+    if !ok {
+      return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("No client %q is known to AdGuard Home", id))
+    }
+
+    // Per-client stats are optional; the section says so when the query log is unavailable
+    stop = timeFetch(c)
+    clientStats, err := getClientStats(ctx, config, client.IP)
+    stop()
+    if err != nil {
+      c.Logger().Warn("client stats: ", err)
+    }
+
+    content := generateClientContent(client, statsResponse, generateClientStats(clientStats, parseTopN(c), config.maxRows()), anonymizeRequested(c, config))
+    return renderPage(c, config, http.StatusOK, displayName(client), content)
+  })
+
+  g.GET("/stats", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    rng, err := parseStatsRange(c, config.timezone())
     if err != nil {
-      return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching stats: %v", err))
+      return echo.NewHTTPError(http.StatusBadRequest, "Invalid time range: "+err.Error())
+    }
+
+    // Scripts asking for JSON get the raw stats, as on /api/stats
+    if negotiateJSON(c) {
+      var statsResponse *StatsResponse
+      if rng != nil {
+        statsResponse, _, _, err = getStatsInRange(ctx, config, rng)
+      } else {
+        statsResponse, _, err = getStats(ctx, config)
+      }
+      if err != nil {
+        return echo.NewHTTPError(http.StatusBadGateway, "Error fetching stats from AdGuard Home").SetInternal(err)
+      }
+      if anonymizeRequested(c, config) {
+        statsResponse = anonymizedStats(statsResponse)
+      }
+      return c.JSON(http.StatusOK, statsResponse)
+    }
+
+    // Fetch stats and a query type sample from AdGuard Home in parallel
+    var statsResponse *StatsResponse
+    var fetchedAt time.Time
+    var queryTypes map[string]int
+    var sampled int
+    var blockedClients []map[string]int
+    var blockedSampled int
+    var blockedCategories map[string]string
+    groupBlocked := c.QueryParam("group") == "category"
+    rangeSupported := true
+    stop := timeFetch(c)
+    err = fetchConcurrently(
+      func() (err error) {
+        if rng != nil {
+          statsResponse, fetchedAt, rangeSupported, err = getStatsInRange(ctx, config, rng)
+          return err
+        }
+        statsResponse, fetchedAt, err = getStats(ctx, config)
+        return err
+      },
+      func() error {
+        // The breakdown is optional; the section is hidden when the query log is unavailable
+        var err error
+        if queryTypes, sampled, err = getQueryTypes(ctx, config); err != nil {
+          c.Logger().Warn("query types: ", err)
+        }
+        return nil
+      },
+      func() error {
+        // Also optional and hidden without the query log
+        var err error
+        if blockedClients, blockedSampled, err = getBlockedClients(ctx, config); err != nil {
+          c.Logger().Warn("blocked clients: ", err)
+        }
+        return nil
+      },
+      func() error {
+        // Without categories the blocked domains stay a flat list
+        if !groupBlocked {
+          return nil
+        }
+        var err error
+        if blockedCategories, err = getBlockedCategories(ctx, config); err != nil {
+          c.Logger().Warn("blocked categories: ", err)
+        }
+        return nil
+      },
+    )
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching stats from AdGuard Home").SetInternal(err)
     }
 
     // Generate HTML tables for each section
-    topDomainsTable := generateStatsTable("Top Queried Domains", statsResponse.TopQueriedDomains, "Count")
-    topClientsTable := generateStatsTable("Top Clients", statsResponse.TopClients, "Count")
-    topBlockedTable := generateStatsTable("Top Blocked Domains", statsResponse.TopBlockedDomains, "Count")
-
-    return c.Render(http.StatusOK, "base.html", map[string]interface{}{
-      "Title": "DNS Statistics - Aghamon",
-      "Content": template.HTML(generateStatsContent(
-        statsResponse.TimeUnits,
-        statsResponse.NumDNSQueries,
-        statsResponse.NumBlockedFiltering,
-        statsResponse.AvgProcessingTime,
-        topDomainsTable,
-        topClientsTable,
-        topBlockedTable,
-      )),
+    top := parseTopN(c)
+    topDomainsTable := generateStatsTable("Top Queried Domains", statsResponse.TopQueriedDomains, "Count", top, config.maxRows())
+    topClients := statsResponse.TopClients
+    if anonymizeRequested(c, config) {
+      topClients, blockedClients = anonymizedCounts(topClients), anonymizedCounts(blockedClients)
+    }
+    topClientsTable := generateStatsTable("Top Clients", topClients, "Count", top, config.maxRows())
+    topBlockedTable := generateGroupedStatsTable("Top Blocked Domains", statsResponse.TopBlockedDomains, blockedCategories, "Count", top, config.maxRows())
+    blockedClientsTable := generateBlockedClientsTable(blockedClients, blockedSampled, top, config.maxRows())
+
+    printView := c.QueryParam("format") == "print"
+
+    // ?compare=previous adds today vs yesterday
+    compare := c.QueryParam("compare") == "previous"
+    comparison := ""
+    if compare {
+      stop = timeFetch(c)
+      cmp, ok, err := comparePreviousDay(ctx, config, statsResponse, time.Now())
+      stop()
+      if err != nil {
+        c.Logger().Warn("stats comparison: ", err)
+      }
+      comparison = generateComparisonTable(cmp, ok)
+    }
+
+    // The header shows the chosen range, or the default window when AdGuard Home ignored it
+    period := "Last " + formatStatsPeriod(statsResponse)
+    rangeNotice := ""
+    if rng != nil && rangeSupported {
+      period = formatStatsRange(rng, config.timezone())
+    } else if rng != nil {
+      rangeNotice = `<div class="summary"><p>This AdGuard Home version doesn't support stats time ranges; showing its default window instead.</p></div>`
+      rng = nil
+    }
+
+    controls := ""
+    refresh := ""
+    if !printView {
+      refresh = refreshURL(c)
+      compareLink := fmt.Sprintf(`<a href="%s">Compare with previous day</a>`, withQuery(appURL("/stats"), c.QueryParams(), "compare", "previous"))
+      if compare {
+        compareLink = fmt.Sprintf(`<a href="%s">Hide comparison</a>`, withQuery(appURL("/stats"), c.QueryParams(), "compare", ""))
+      }
+      groupLink := fmt.Sprintf(`<a href="%s">Group blocked domains by category</a>`, withQuery(appURL("/stats"), c.QueryParams(), "group", "category"))
+      if groupBlocked {
+        groupLink = fmt.Sprintf(`<a href="%s">Ungroup blocked domains</a>`, withQuery(appURL("/stats"), c.QueryParams(), "group", ""))
+      }
+      controls = fmt.Sprintf(`<p><a href="%s">Print view</a> | %s | %s</p>`, withQuery(appURL("/stats"), c.QueryParams(), "format", "print"), compareLink, groupLink)
+      controls += generateStatsRangeForm(c.QueryParams(), rng, config.timezone())
+      if !config.readOnly() {
+        controls += generateActionForm(appURL("/stats/reset"), csrfToken(c), "Reset Statistics", "Reset all AdGuard Home statistics? This cannot be undone.", nil)
+      }
+    }
+
+    content := generateStatsContent(
+      period,
+      statsResponse.NumDNSQueries,
+      generateQueryReconciliation(reconcileQueries(statsResponse, config.statsMismatchThreshold())),
+      statsResponse.NumBlockedFiltering,
+      statsResponse.AvgProcessingTime,
+      rangeNotice+generateSkippedFieldsNotice(statsResponse.Skipped)+comparison,
+      topDomainsTable,
+      topClientsTable,
+      topBlockedTable,
+      blockedClientsTable,
+      generateQueryTypesTable(queryTypes, sampled, config.maxRows()),
+      controls,
+    ) + generateLastUpdated(fetchedAt.In(config.timezone()), refresh)
+
+    if printView {
+      return renderPrintReport(c, config, statsResponse, fetchedAt, rng, content)
+    }
+    return renderPage(c, config, http.StatusOK, sectionFor("/stats").Title, content)
+  }, bypassCache(statsPageKeys...))
+
+  g.GET("/querylog", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    // Filters are passed through to AdGuard Home so paging stays consistent
+    limit := queryInt(c, "limit", defaultQueryLogLimit, 1, maxQueryLogLimit)
+    params := queryLogFilters(c)
+    params.Set("limit", strconv.Itoa(limit))
+
+    // Open the response before writing anything so connection and auth errors still get an error page
+    body, err := openAdGuard(ctx, config, "/querylog?"+params.Encode())
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching the query log from AdGuard Home").SetInternal(err)
+    }
+    defer body.Close()
+
+    // Rows are written as they are decoded, so memory stays bounded for large limits
+    loc := config.timezone()
+    anonymize := anonymizeRequested(c, config)
+    return streamPage(c, config, http.StatusOK, sectionFor("/querylog").Title, func(w io.Writer) error {
+      io.WriteString(w, generateQueryLogHeader(c.QueryParams(), limit))
+      io.WriteString(w, generateQueryLogTableStart())
+
+      count := 0
+      maxRows := config.maxRows()
+      oldest, err := decodeQueryLog(body, func(entry QueryLogEntry) error {
+        count++
+        if count > maxRows {
+          return nil
+        }
+        if _, err := io.WriteString(w, generateQueryLogRow(entry, loc, anonymize)); err != nil {
+          return err
+        }
+        if count%queryLogFlushRows == 0 {
+          c.Response().Flush()
+        }
+        return nil
+      })
+      switch {
+      case err != nil:
+        io.WriteString(w, `
+      <tr>
+        <td colspan="7" class="empty-row">The query log could not be read completely</td>
+      </tr>`)
+      case count == 0:
+        io.WriteString(w, emptyTableRow(7))
+      }
+
+      io.WriteString(w, `</tbody></table></div>`)
+      io.WriteString(w, generateTruncatedNotice(min(count, maxRows), count))
+      io.WriteString(w, generateQueryLogNav(c.QueryParams(), count, limit, oldest))
+      return err
     })
-  })
+  }, middleware.Gzip())
+
+  // Streams the query log as newline-delimited JSON for log shippers and jq, following the
+  // older_than cursor across AdGuard Home pages until ?limit= entries are written
+  g.GET("/querylog.ndjson", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+    limit := queryInt(c, "limit", defaultQueryLogLimit, 1, maxQueryLogExportLimit)
+    anonymize := anonymizeRequested(c, config)
+
+    params := queryLogFilters(c)
+    pageSize := min(limit, maxQueryLogLimit)
+    params.Set("limit", strconv.Itoa(pageSize))
+
+    // As on /querylog, the first page is opened before the status code is sent
+    body, err := openAdGuard(ctx, config, "/querylog?"+params.Encode())
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching the query log from AdGuard Home").SetInternal(err)
+    }
+
+    c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+    c.Response().WriteHeader(http.StatusOK)
+    enc := json.NewEncoder(c.Response())
+    enc.SetEscapeHTML(false)
+
+    written := 0
+    for {
+      count := 0
+      oldest, err := decodeQueryLog(body, func(entry QueryLogEntry) error {
+        if written >= limit {
+          return nil
+        }
+        count++
+        written++
+        if anonymize {
+          entry.Client = anonymizeIP(entry.Client)
+        }
+        if err := enc.Encode(entry); err != nil {
+          return err
+        }
+        if written%queryLogFlushRows == 0 {
+          c.Response().Flush()
+        }
+        return nil
+      })
+      body.Close()
+
+      // The status is already sent, so a failure can only end the stream early
+      if err != nil {
+        c.Logger().Error("query log export: ", err)
+        return nil
+      }
+      if written >= limit || count < pageSize || oldest == "" {
+        return nil
+      }
+
+      pageSize = min(limit-written, maxQueryLogLimit)
+      params.Set("limit", strconv.Itoa(pageSize))
+      params.Set("older_than", oldest)
+      if body, err = openAdGuard(ctx, config, "/querylog?"+params.Encode()); err != nil {
+        c.Logger().Error("query log export: ", err)
+        return nil
+      }
+    }
+  }, middleware.Gzip())
+
+  g.GET("/upstreams", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
 
-  e.GET("/upstreams", func(c echo.Context) error {
     // Fetch stats from AdGuard Home
-    statsResponse, err := fetchStats(config)
+    stop := timeFetch(c)
+    statsResponse, fetchedAt, err := getStats(ctx, config)
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching upstreams from AdGuard Home").SetInternal(err)
+    }
+
+    // Correlate counts and average times into one table
+    upstreams := mergeUpstreams(statsResponse)
+    sortKey := c.QueryParam("sort")
+    desc := upstreamSortDesc(sortKey, c.QueryParam("order"))
+    if !sortUpstreams(upstreams, sortKey, desc) {
+      sortKey = defaultUpstreamSort
+      desc = upstreamSortDesc(sortKey, c.QueryParam("order"))
+      sortUpstreams(upstreams, sortKey, desc)
+    }
+    upstreamsTable := generateUpstreamsTable("Top Upstreams", upstreams, c.QueryParams(), sortKey, desc, parseTopN(c), config.maxRows())
+    if len(upstreams) == 0 && detectedVersion().olderThan(0, 107, 36) {
+      upstreamsTable = fmt.Sprintf(`<div class="summary"><p>AdGuard Home %s doesn't report upstream statistics; v0.107.36 or newer does.</p></div>`,
+        template.HTMLEscapeString(detectedVersion().String())) + upstreamsTable
+    }
+
+    // The histogram is optional; it is hidden when the query log is unavailable or has no timings
+    histogram := ""
+    stop = timeFetch(c)
+    queryLog, err := getQuerySample(ctx, config)
+    stop()
+    if err != nil {
+      c.Logger().Warn("upstream latencies: ", err)
+    } else {
+      bounds := config.latencyBuckets()
+      histogram = generateLatencyHistogram(upstreamLatencies(queryLog, bounds), bounds, len(queryLog.Data), config.maxRows())
+    }
+
+    content := generateUpstreamsContent(upstreamsTable+histogram) + generateLastUpdated(fetchedAt.In(config.timezone()), refreshURL(c))
+
+    return renderPage(c, config, http.StatusOK, sectionFor("/upstreams").Title, content)
+  }, bypassCache("stats", "querysample"))
+
+  g.GET("/status", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    // Fetch status from AdGuard Home; this also refreshes the header's protection badge
+    stop := timeFetch(c)
+    statusResponse, err := getStatus(ctx, config, config.cacheTTL())
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching status from AdGuard Home").SetInternal(err)
+    }
+
+    return renderPage(c, config, http.StatusOK, sectionFor("/status").Title, generateStatusContent(config, statusResponse))
+  })
+
+  g.GET("/rewrites", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    stop := timeFetch(c)
+    rewrites, fetchedAt, err := getRewrites(ctx, config)
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching DNS rewrites from AdGuard Home").SetInternal(err)
+    }
+
+    // Add and delete controls are only offered when changes are allowed
+    action := ""
+    if !config.readOnly() {
+      action = appURL("/rewrites")
+    }
+
+    content := generateRewritesContent(rewrites, action, csrfToken(c), config.maxRows()) +
+      generateLastUpdated(fetchedAt.In(config.timezone()), refreshURL(c))
+    return renderPage(c, config, http.StatusOK, sectionFor("/rewrites").Title, content)
+  }, bypassCache("rewrites"))
+
+  g.GET("/access", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    stop := timeFetch(c)
+    accessList, fetchedAt, err := getAccessList(ctx, config)
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching access settings from AdGuard Home").SetInternal(err)
+    }
+
+    // The edit form is only offered when changes are allowed
+    action := ""
+    if !config.readOnly() {
+      action = appURL("/access")
+    }
+
+    content := generateAccessContent(accessList, action, csrfToken(c), config.maxRows()) +
+      generateLastUpdated(fetchedAt.In(config.timezone()), refreshURL(c))
+    return renderPage(c, config, http.StatusOK, sectionFor("/access").Title, content)
+  }, bypassCache("access"))
+
+  g.GET("/filtering", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+
+    stop := timeFetch(c)
+    filteringStatus, fetchedAt, err := getFilteringStatus(ctx, config)
+    stop()
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching filtering status from AdGuard Home").SetInternal(err)
+    }
+
+    // Toggles and the refresh button are only offered when changes are allowed
+    toggleAction, controls := "", ""
+    if !config.readOnly() {
+      toggleAction = appURL("/filtering/toggle")
+      controls = generateActionForm(appURL("/filtering/refresh"), csrfToken(c), "Update Blocklists", "Download all blocklists again now?", nil)
+    }
+
+    content := generateFilteringContent(filteringStatus, config.timezone(), toggleAction, csrfToken(c), controls, config.maxRows()) +
+      generateLastUpdated(fetchedAt.In(config.timezone()), refreshURL(c))
+    return renderPage(c, config, http.StatusOK, sectionFor("/filtering").Title, content)
+  }, bypassCache("filtering"))
+
+  if !config.readOnly() {
+    g.POST("/rewrites/add", func(c echo.Context) error {
+      config := currentConfig()
+      ctx := c.Request().Context()
+      rewrite := Rewrite{Domain: strings.TrimSpace(c.FormValue("domain")), Answer: strings.TrimSpace(c.FormValue("answer"))}
+      if rewrite.Domain == "" || rewrite.Answer == "" {
+        setFlash(c, "error", "A rewrite needs both a domain and an answer.")
+        return c.Redirect(http.StatusSeeOther, appURL("/rewrites"))
+      }
+
+      if err := addRewrite(ctx, config, rewrite); err != nil {
+        c.Logger().Error("rewrite add: ", err)
+        setFlash(c, "error", "Adding the rewrite failed. Check the Aghamon log for details.")
+      } else {
+        cache.invalidate("rewrites")
+        setFlash(c, "success", fmt.Sprintf("Rewrite %s → %s has been added.", rewrite.Domain, rewrite.Answer))
+      }
+      return c.Redirect(http.StatusSeeOther, appURL("/rewrites"))
+    })
+
+    g.POST("/rewrites/delete", func(c echo.Context) error {
+      config := currentConfig()
+      ctx := c.Request().Context()
+      rewrite := Rewrite{Domain: c.FormValue("domain"), Answer: c.FormValue("answer")}
+
+      if err := deleteRewrite(ctx, config, rewrite); err != nil {
+        c.Logger().Error("rewrite delete: ", err)
+        setFlash(c, "error", "Deleting the rewrite failed. Check the Aghamon log for details.")
+      } else {
+        cache.invalidate("rewrites")
+        setFlash(c, "success", fmt.Sprintf("Rewrite %s → %s has been deleted.", rewrite.Domain, rewrite.Answer))
+      }
+      return c.Redirect(http.StatusSeeOther, appURL("/rewrites"))
+    })
+
+    g.POST("/access", func(c echo.Context) error {
+      config := currentConfig()
+      ctx := c.Request().Context()
+      accessList := &AccessList{
+        AllowedClients:    accessEntries(c.FormValue("allowed_clients")),
+        DisallowedClients: accessEntries(c.FormValue("disallowed_clients")),
+        BlockedHosts:      accessEntries(c.FormValue("blocked_hosts")),
+      }
+
+      if err := setAccessList(ctx, config, accessList); err != nil {
+        c.Logger().Error("access set: ", err)
+        setFlash(c, "error", "Saving the access settings failed. Check the Aghamon log for details.")
+      } else {
+        cache.invalidate("access")
+        setFlash(c, "success", "Access settings have been saved.")
+      }
+      return c.Redirect(http.StatusSeeOther, appURL("/access"))
+    })
+
+    g.POST("/filtering/toggle", func(c echo.Context) error {
+      config := currentConfig()
+      ctx := c.Request().Context()
+      listURL := c.FormValue("url")
+      whitelist := c.FormValue("whitelist") == "true"
+      enabled := c.FormValue("enabled") == "true"
+
+      // Look the list up in a fresh status so only configured lists can be changed and the
+      // name sent back to AdGuard Home is current
+      filteringStatus, err := fetchFilteringStatus(ctx, config)
+      if err != nil {
+        c.Logger().Error("filter toggle: ", err)
+        setFlash(c, "error", "Changing the list failed. Check the Aghamon log for details.")
+        return c.Redirect(http.StatusSeeOther, appURL("/filtering"))
+      }
+      filters := filteringStatus.Filters
+      if whitelist {
+        filters = filteringStatus.WhitelistFilters
+      }
+      i := slices.IndexFunc(filters, func(f Filter) bool { return f.URL == listURL })
+      if i < 0 {
+        setFlash(c, "error", "That list is not configured in AdGuard Home.")
+        return c.Redirect(http.StatusSeeOther, appURL("/filtering"))
+      }
+
+      state := "disabled"
+      if enabled {
+        state = "enabled"
+      }
+      if err := setFilterEnabled(ctx, config, filters[i], whitelist, enabled); err != nil {
+        c.Logger().Error("filter toggle: ", err)
+        setFlash(c, "error", "Changing the list failed. Check the Aghamon log for details.")
+      } else {
+        cache.invalidate("filtering")
+        setFlash(c, "success", fmt.Sprintf("%s has been %s.", displayFilterName(filters[i]), state))
+      }
+      return c.Redirect(http.StatusSeeOther, appURL("/filtering"))
+    })
+
+    g.POST("/filtering/refresh", func(c echo.Context) error {
+      config := currentConfig()
+      ctx := c.Request().Context()
+
+      // Rule counts before and after tell how much the update changed
+      before, err := fetchFilteringStatus(ctx, config)
+      if err != nil {
+        c.Logger().Error("filter refresh: ", err)
+        setFlash(c, "error", "Updating the blocklists failed. Check the Aghamon log for details.")
+        return c.Redirect(http.StatusSeeOther, appURL("/filtering"))
+      }
+      updated, err := refreshFilters(ctx, config, false)
+      if err != nil {
+        c.Logger().Error("filter refresh: ", err)
+        setFlash(c, "error", "Updating the blocklists failed. Check the Aghamon log for details.")
+        return c.Redirect(http.StatusSeeOther, appURL("/filtering"))
+      }
+      cache.invalidate("filtering")
+
+      after, err := fetchFilteringStatus(ctx, config)
+      if err != nil {
+        c.Logger().Warn("filter refresh: ", err)
+        setFlash(c, "success", fmt.Sprintf("Blocklists have been updated; lists changed: %s.", formatCount(updated)))
+        return c.Redirect(http.StatusSeeOther, appURL("/filtering"))
+      }
+      rulesBefore, rulesAfter := totalRules(before.Filters), totalRules(after.Filters)
+      setFlash(c, "success", fmt.Sprintf("Blocklists have been updated; lists changed: %s, rules: %s (%s).",
+        formatCount(updated), formatCount(rulesAfter), signed(formatCount(rulesAfter-rulesBefore))))
+      return c.Redirect(http.StatusSeeOther, appURL("/filtering"))
+    })
+
+    g.POST("/stats/reset", func(c echo.Context) error {
+      config := currentConfig()
+      ctx := c.Request().Context()
+      if err := resetStats(ctx, config); err != nil {
+        c.Logger().Error("stats reset: ", err)
+        setFlash(c, "error", "Resetting statistics failed. Check the Aghamon log for details.")
+      } else {
+        // Everything the /stats page shows is fetched again after the redirect
+        cache.invalidate(statsPageKeys...)
+        setFlash(c, "success", "Statistics have been reset.")
+      }
+      return c.Redirect(http.StatusSeeOther, appURL("/stats"))
+    })
+  }
+
+  if config.Server.LiveUpdates.Interval > 0 {
+    g.GET("/ws/stats", newLiveStatsHandler(config))
+  }
+
+  g.GET("/version", func(c echo.Context) error {
+    return c.JSON(http.StatusOK, struct {
+      BuildInfo
+      AdGuardVersion string `json:"adguard_version"`
+    }{buildInfo(), detectedVersion().String()})
+  })
+
+  // Reports Aghamon's own health; AdGuard Home outages show up as the circuit breaker state
+  g.GET("/healthz", func(c echo.Context) error {
+    return c.JSON(http.StatusOK, map[string]interface{}{
+      "status": "ok",
+      "adguard": breaker.status(currentConfig().breakerCooldown()),
+    })
+  })
+
+  // Shows the configuration in effect after includes and reloads, only with server.log_level: debug
+  g.GET("/debug/config", func(c echo.Context) error {
+    config := currentConfig()
+    if !config.debug() {
+      return echo.ErrNotFound
+    }
+    resolved, err := redactedConfig(config)
+    if err != nil {
+      return echo.NewHTTPError(http.StatusInternalServerError, "Error encoding the configuration").SetInternal(err)
+    }
+    return c.JSON(http.StatusOK, resolved)
+  })
+
+  // The JSON API may be called cross-origin from the origins in server.cors.allowed_origins
+  api := g.Group("/api")
+  if origins := config.Server.CORS.AllowedOrigins; len(origins) > 0 {
+    api.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+      AllowOrigins: origins,
+      AllowMethods: []string{http.MethodGet, http.MethodHead, http.MethodOptions},
+    }))
+  }
+
+  api.GET("/clients", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+    clientsResponse, _, err := getClients(ctx, config)
     if err != nil {
-      return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching upstreams: %v", err))
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching clients from AdGuard Home").SetInternal(err)
+    }
+
+    clients := visibleClients(config, clientsResponse)
+    if anonymizeRequested(c, config) {
+      clients = anonymizedClients(clients)
     }
+    return c.JSON(http.StatusOK, clients)
+  })
 
-    // Generate HTML tables for upstreams
-    topUpstreamsTable := generateStatsTable("Top Upstreams by Response Count", statsResponse.TopUpstreamsResponses, "Count")
-    topUpstreamsTimeTable := generateUpstreamsTable("Top Upstreams by Average Response Time", statsResponse.TopUpstreamsAvgTime, "Time")
+  api.GET("/summary", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
 
-    return c.Render(http.StatusOK, "base.html", map[string]interface{}{
-      "Title": "DNS Upstreams - Aghamon",
-      "Content": template.HTML(generateUpstreamsContent(topUpstreamsTable, topUpstreamsTimeTable)),
+    var statsResponse *StatsResponse
+    var fetchedAt time.Time
+    var clientsResponse *ClientsResponse
+    err := fetchConcurrently(
+      func() (err error) {
+        statsResponse, fetchedAt, err = getStats(ctx, config)
+        return err
+      },
+      func() (err error) {
+        clientsResponse, _, err = getClients(ctx, config)
+        return err
+      },
+    )
+    // Monitors check either the status code or upstream_ok, so report failures both ways
+    if err != nil {
+      c.Logger().Warn("summary: ", err)
+      return c.JSON(http.StatusServiceUnavailable, Summary{})
+    }
+
+    return c.JSON(http.StatusOK, Summary{
+      StatsSummary: summarizeStats(statsResponse, fetchedAt),
+      Clients:      len(visibleClients(config, clientsResponse)),
+      UpstreamOK:   true,
     })
   })
 
-  e.Logger.Fatal(e.Start(":8080"))
+  api.GET("/stats", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+    statsResponse, _, err := getStats(ctx, config)
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching stats from AdGuard Home").SetInternal(err)
+    }
+
+    if anonymizeRequested(c, config) {
+      statsResponse = anonymizedStats(statsResponse)
+    }
+    return c.JSON(http.StatusOK, statsResponse)
+  })
+
+  api.GET("/upstreams", func(c echo.Context) error {
+    config := currentConfig()
+    ctx := c.Request().Context()
+    statsResponse, _, err := getStats(ctx, config)
+    if err != nil {
+      return echo.NewHTTPError(http.StatusBadGateway, "Error fetching upstreams from AdGuard Home").SetInternal(err)
+    }
+
+    upstreams := mergeUpstreams(statsResponse)
+    if upstreams == nil {
+      upstreams = []UpstreamStat{}
+    }
+    return c.JSON(http.StatusOK, upstreams)
+  })
+
+  // Reload the configuration file on SIGHUP without restarting
+  go watchReload(e.Logger, *configPath)
+
+  // Stop on SIGINT/SIGTERM, letting in-flight requests and the background poller finish
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  var background sync.WaitGroup
+  if interval := config.pollInterval(); interval > 0 {
+    background.Add(1)
+    go func() {
+      defer background.Done()
+      pollAdGuard(ctx, e.Logger, interval)
+    }()
+  }
+
+  go func() {
+    var err error
+    tlsConfig := config.Server.TLS
+    switch {
+    case tlsConfig.CertFile != "":
+      err = e.StartTLS(":8080", tlsConfig.CertFile, tlsConfig.KeyFile)
+    case tlsConfig.AutoDomain != "":
+      // Let's Encrypt validates over TLS-ALPN, so port 443 must reach this listener
+      e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(tlsConfig.AutoDomain)
+      if tlsConfig.CacheDir != "" {
+        e.AutoTLSManager.Cache = autocert.DirCache(tlsConfig.CacheDir)
+      }
+      err = e.StartAutoTLS(":8080")
+    default:
+      err = e.Start(":8080")
+    }
+    if !errors.Is(err, http.ErrServerClosed) {
+      e.Logger.Fatal(err)
+    }
+  }()
+
+  <-ctx.Done()
+  e.Logger.Info("Shutting down")
+
+  shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+  if err := e.Shutdown(shutdownCtx); err != nil {
+    e.Logger.Error("shutdown: ", err)
+  }
+  background.Wait()
 }
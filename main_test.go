@@ -0,0 +1,1625 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "compress/zlib"
+  "context"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/base64"
+  "encoding/json"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "html/template"
+  "io"
+  "log"
+  "math"
+  "math/big"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "os"
+  "path/filepath"
+  "slices"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/labstack/echo/v4"
+  "golang.org/x/sync/semaphore"
+)
+
+// testClientsJSON is a canned /control/clients response
+const testClientsJSON = `{
+  "clients": [{"ip": "192.168.1.10", "name": "laptop", "source": "persistent", "tags": ["device_laptop"], "whois_info": {}}],
+  "auto_clients": [
+    {"ip": "192.168.1.20", "name": "phone", "source": "rdns", "whois_info": {"country": "US", "orgname": "Org", "city": "NYC"}},
+    {"ip": "2001:db8:0:0::1", "name": "", "source": "arp", "whois_info": {}}
+  ],
+  "supported_tags": ["device_laptop", "device_phone"]
+}`
+
+// testStatsJSON is a canned /control/stats response covering the last 24 hours
+const testStatsJSON = `{
+  "time_units": "hours",
+  "top_queried_domains": [{"example.com": 120}, {"example.org": 80}],
+  "top_clients": [{"192.168.1.10": 150}, {"192.168.1.20": 50}],
+  "top_blocked_domains": [{"ads.example": 30}],
+  "top_upstreams_responses": [{"1.1.1.1:53": 150}, {"8.8.8.8:53": 50}],
+  "top_upstreams_avg_time": [{"1.1.1.1:53": 0.012345}, {"8.8.8.8:53": 0.2}],
+  "dns_queries": [10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 150, 160, 170, 180, 190, 200, 210, 220, 230, 240],
+  "blocked_filtering": [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24],
+  "num_dns_queries": 3000,
+  "num_blocked_filtering": 300,
+  "avg_processing_time": 0.004321
+}`
+
+// fakeAdGuard is a stand-in AdGuard Home that serves canned responses by path and records the
+// requests it receives and the connections opened to it
+type fakeAdGuard struct {
+  *httptest.Server
+
+  mu       sync.Mutex
+  routes   map[string]http.HandlerFunc
+  requests []*http.Request
+  conns    atomic.Int32
+}
+
+// newFakeAdGuard starts a fake AdGuard Home serving /control/clients and /control/stats, plus
+// routes (keyed by path, overriding those two), and makes it the active configuration with
+// config appended to the adguard section, e.g. "  cache_ttl: 10\n"
+func newFakeAdGuard(t testing.TB, config string, routes map[string]http.HandlerFunc) *fakeAdGuard {
+  t.Helper()
+
+  f := &fakeAdGuard{routes: map[string]http.HandlerFunc{
+    "/control/clients": jsonHandler(testClientsJSON),
+    "/control/stats":   jsonHandler(testStatsJSON),
+  }}
+  for path, handler := range routes {
+    f.routes[path] = handler
+  }
+
+  f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serve))
+  f.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+    if state == http.StateNew {
+      f.conns.Add(1)
+    }
+  }
+  f.Start()
+  t.Cleanup(f.Close)
+
+  useConfig(t, "adguard:\n  server_url: \""+f.URL+"\"\n  username: \"admin\"\n  password: \"secret\"\n"+config)
+  return f
+}
+
+// serve records the request and answers from the routes, 404 for unknown paths
+func (f *fakeAdGuard) serve(w http.ResponseWriter, r *http.Request) {
+  f.mu.Lock()
+  f.requests = append(f.requests, r.Clone(r.Context()))
+  handler, ok := f.routes[r.URL.Path]
+  f.mu.Unlock()
+
+  if !ok {
+    http.NotFound(w, r)
+    return
+  }
+  handler(w, r)
+}
+
+// lastRequest returns the most recent request the fake received
+func (f *fakeAdGuard) lastRequest(t *testing.T) *http.Request {
+  t.Helper()
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  if len(f.requests) == 0 {
+    t.Fatal("AdGuard Home received no request")
+  }
+  return f.requests[len(f.requests)-1]
+}
+
+// requestPaths returns the paths of the requests the fake received so far
+func (f *fakeAdGuard) requestPaths() []string {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var paths []string
+  for _, r := range f.requests {
+    paths = append(paths, r.URL.Path)
+  }
+  return paths
+}
+
+// jsonHandler answers every request with body as JSON
+func jsonHandler(body string) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Write([]byte(body))
+  }
+}
+
+// useConfig parses the YAML configuration and makes it active with a fresh AdGuard Home client,
+// cache, circuit breaker and version, so tests don't see each other's state
+func useConfig(t testing.TB, yaml string) *Config {
+  t.Helper()
+
+  config, err := parseConfig(strings.NewReader(yaml))
+  if err != nil {
+    t.Fatalf("parseConfig: %v", err)
+  }
+  client, err := newHTTPClient(config)
+  if err != nil {
+    t.Fatalf("newHTTPClient: %v", err)
+  }
+
+  activeConfig.Store(config)
+  httpClient.Store(client)
+  cache.clear()
+  breaker = &circuitBreaker{state: breakerClosed}
+  storeVersion(AdGuardVersion{})
+  return config
+}
+
+// useDefaultConfig makes a minimal configuration active, for tests of the page generators
+func useDefaultConfig(t testing.TB) *Config {
+  t.Helper()
+  return useConfig(t, "adguard:\n  server_url: \"http://127.0.0.1:1\"\n")
+}
+
+func TestFetchClientsParsesResponse(t *testing.T) {
+  newFakeAdGuard(t, "", nil)
+
+  clients, err := fetchClients(t.Context(), currentConfig())
+  if err != nil {
+    t.Fatalf("fetchClients: %v", err)
+  }
+
+  if len(clients.Clients) != 1 || clients.Clients[0].Name != "laptop" || clients.Clients[0].Tags[0] != "device_laptop" {
+    t.Errorf("clients = %+v, want the laptop with its tag", clients.Clients)
+  }
+  if len(clients.AutoClients) != 2 || clients.AutoClients[0].WhoisInfo.Country != "US" {
+    t.Errorf("auto clients = %+v, want the phone with its whois info and the IPv6 client", clients.AutoClients)
+  }
+  if len(clients.SupportedTags) != 2 {
+    t.Errorf("supported tags = %v, want 2", clients.SupportedTags)
+  }
+}
+
+func TestFetchStatsParsesResponse(t *testing.T) {
+  newFakeAdGuard(t, "", nil)
+
+  stats, err := fetchStats(t.Context(), currentConfig(), nil)
+  if err != nil {
+    t.Fatalf("fetchStats: %v", err)
+  }
+
+  if stats.NumDNSQueries != 3000 || stats.NumBlockedFiltering != 300 || stats.AvgProcessingTime != 0.004321 {
+    t.Errorf("totals = %d, %d, %v; want 3000, 300, 0.004321", stats.NumDNSQueries, stats.NumBlockedFiltering, stats.AvgProcessingTime)
+  }
+  if stats.TimeUnits != "hours" || len(stats.DNSQueries) != 24 || len(stats.BlockedFiltering) != 24 {
+    t.Errorf("series = %s, %d, %d; want hours, 24, 24", stats.TimeUnits, len(stats.DNSQueries), len(stats.BlockedFiltering))
+  }
+  if stats.TopQueriedDomains[0]["example.com"] != 120 || stats.TopUpstreamsAvgTime[1]["8.8.8.8:53"] != 0.2 {
+    t.Errorf("top lists = %v, %v", stats.TopQueriedDomains, stats.TopUpstreamsAvgTime)
+  }
+  if len(stats.Skipped) != 0 {
+    t.Errorf("skipped fields = %v, want none", stats.Skipped)
+  }
+}
+
+func TestFetchSendsHeaders(t *testing.T) {
+  f := newFakeAdGuard(t, "", nil)
+
+  if _, err := fetchClients(t.Context(), currentConfig()); err != nil {
+    t.Fatalf("fetchClients: %v", err)
+  }
+
+  req := f.lastRequest(t)
+  if req.URL.Path != "/control/clients" {
+    t.Errorf("path = %s, want /control/clients", req.URL.Path)
+  }
+  wantAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+  if got := req.Header.Get("Authorization"); got != wantAuth {
+    t.Errorf("Authorization = %q, want %q", got, wantAuth)
+  }
+  if got := req.Header.Get("User-Agent"); got != "aghamon/"+version {
+    t.Errorf("User-Agent = %q, want aghamon/%s", got, version)
+  }
+  if got := req.Header.Get("Accept"); got != "application/json" {
+    t.Errorf("Accept = %q, want application/json", got)
+  }
+  if got := req.Header.Get("Referer"); got != f.URL+"/" {
+    t.Errorf("Referer = %q, want %s/", got, f.URL)
+  }
+}
+
+func TestFetchRejectsNon200(t *testing.T) {
+  newFakeAdGuard(t, "", map[string]http.HandlerFunc{
+    "/control/clients": func(w http.ResponseWriter, r *http.Request) {
+      http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    },
+    "/control/stats": func(w http.ResponseWriter, r *http.Request) {
+      w.WriteHeader(http.StatusInternalServerError)
+    },
+  })
+
+  for _, tc := range []struct {
+    name  string
+    fetch func() error
+    code  int
+  }{
+    {"clients", func() error { _, err := fetchClients(t.Context(), currentConfig()); return err }, http.StatusUnauthorized},
+    {"stats", func() error { _, err := fetchStats(t.Context(), currentConfig(), nil); return err }, http.StatusInternalServerError},
+  } {
+    err := tc.fetch()
+    var statusErr *upstreamStatusError
+    if !errors.As(err, &statusErr) {
+      t.Errorf("%s: error = %v, want an *upstreamStatusError", tc.name, err)
+      continue
+    }
+    if statusErr.code != tc.code {
+      t.Errorf("%s: status = %d, want %d", tc.name, statusErr.code, tc.code)
+    }
+  }
+}
+
+// useClient makes client the shared AdGuard Home client for the rest of the test
+func useClient(t *testing.T, client *http.Client) {
+  t.Helper()
+  previous := httpClient.Load()
+  httpClient.Store(client)
+  t.Cleanup(func() { httpClient.Store(previous) })
+}
+
+// writeCertPEM writes cert to a PEM file in a test directory and returns its path
+func writeCertPEM(t *testing.T, cert *x509.Certificate) string {
+  t.Helper()
+  path := filepath.Join(t.TempDir(), "ca.pem")
+  if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+// newTestCA returns a self-signed CA certificate that signed nothing the test servers present
+func newTestCA(t *testing.T) *x509.Certificate {
+  t.Helper()
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ca := &x509.Certificate{
+    SerialNumber:          big.NewInt(1),
+    Subject:               pkix.Name{CommonName: "Unknown Test CA"},
+    NotBefore:             time.Now().Add(-time.Hour),
+    NotAfter:              time.Now().Add(time.Hour),
+    IsCA:                  true,
+    KeyUsage:              x509.KeyUsageCertSign,
+    BasicConstraintsValid: true,
+  }
+  der, err := x509.CreateCertificate(rand.Reader, ca, ca, &key.PublicKey, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return cert
+}
+
+func TestCACertFile(t *testing.T) {
+  server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Write([]byte(`{"num_dns_queries": 3000}`))
+  }))
+  // The rejected handshakes are expected, so keep them out of the test output
+  server.Config.ErrorLog = log.New(io.Discard, "", 0)
+  server.StartTLS()
+  t.Cleanup(server.Close)
+
+  for _, tc := range []struct {
+    name     string
+    ca       string
+    insecure bool
+    trusted  bool
+  }{
+    {"server CA", writeCertPEM(t, server.Certificate()), false, true},
+    {"unknown CA", writeCertPEM(t, newTestCA(t)), false, false},
+    {"unknown CA with insecure_skip_verify", writeCertPEM(t, newTestCA(t)), true, false},
+  } {
+    config := &Config{}
+    config.AdGuard.ServerURL = server.URL
+    config.AdGuard.CACertFile = tc.ca
+    config.AdGuard.InsecureSkipVerify = tc.insecure
+    client, err := newHTTPClient(config)
+    if err != nil {
+      t.Fatalf("%s: newHTTPClient: %v", tc.name, err)
+    }
+    useClient(t, client)
+
+    _, err = fetchStats(t.Context(), config, nil)
+    if tc.trusted && err != nil {
+      t.Errorf("%s: fetchStats: %v", tc.name, err)
+    }
+    var unknownAuthority x509.UnknownAuthorityError
+    if !tc.trusted && !errors.As(err, &unknownAuthority) {
+      t.Errorf("%s: error = %v, want an unknown authority error", tc.name, err)
+    }
+  }
+}
+
+func TestCACertFileWithoutCertificates(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "ca.pem")
+  if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+    t.Fatal(err)
+  }
+
+  config := &Config{}
+  config.AdGuard.CACertFile = path
+  if _, err := newHTTPClient(config); err == nil || !strings.Contains(err.Error(), "no PEM certificates") {
+    t.Errorf("newHTTPClient error = %v, want no PEM certificates found", err)
+  }
+}
+
+func TestEmptyTablesShowMessage(t *testing.T) {
+  useDefaultConfig(t)
+  for name, html := range map[string]string{
+    "clients":   generateHTMLTable(nil, defaultClientColumns, nil, nil, 100, false, false),
+    "stats":     generateStatsTable("Top Queried Domains", nil, "Count", 10, 100),
+    "upstreams": generateUpstreamsTable("Upstreams", nil, url.Values{}, defaultUpstreamSort, true, 10, 10),
+  } {
+    if !strings.Contains(html, "No data available") {
+      t.Errorf("%s: empty table has no message:\n%s", name, html)
+    }
+  }
+
+  html := generateHTMLTable(nil, defaultClientColumns, nil, nil, 100, false, false)
+  if want := fmt.Sprintf(`colspan="%d"`, len(defaultClientColumns)); !strings.Contains(html, want) {
+    t.Errorf("clients message does not span every column:\n%s", html)
+  }
+}
+
+func TestFormatMilliseconds(t *testing.T) {
+  useDefaultConfig(t)
+  for _, tc := range []struct {
+    seconds float64
+    want    string
+  }{
+    {0, "0.000 ms"},
+    {0.0004321, "0.432 ms"},
+    {0.012345, "12.35 ms"},
+    {0.2, "200 ms"},
+    {1.5, "1,500 ms"},
+  } {
+    if got := formatMilliseconds(tc.seconds); got != tc.want {
+      t.Errorf("formatMilliseconds(%v) = %q, want %q", tc.seconds, got, tc.want)
+    }
+  }
+
+  count, avg := 3, 12.345
+  html := generateUpstreamsTable("Upstreams", []UpstreamStat{{Upstream: "1.1.1.1:53", Count: &count, AvgTimeMs: &avg}}, url.Values{}, defaultUpstreamSort, true, 10, 10)
+  if !strings.Contains(html, `title="0.012345 s">12.35 ms`) {
+    t.Errorf("upstream time is not shown in milliseconds:\n%s", html)
+  }
+}
+
+func TestDisplayIP(t *testing.T) {
+  for _, tc := range []struct{ in, want string }{
+    {"192.168.1.10", "192.168.1.10"},
+    {"2001:0db8:0000:0000:0000:0000:0000:0001", "2001:db8::1"},
+    {"2001:DB8::/32", "2001:db8::/32"},
+    {"laptop.lan", "laptop.lan"},
+    {"AA:BB:CC:DD:EE:FF", "AA:BB:CC:DD:EE:FF"},
+  } {
+    if got := displayIP(tc.in); got != tc.want {
+      t.Errorf("displayIP(%q) = %q, want %q", tc.in, got, tc.want)
+    }
+  }
+}
+
+func TestSortClientsByAddress(t *testing.T) {
+  clients := []Client{{IP: "laptop"}, {IP: "2001:db8::1"}, {IP: "192.168.1.100"}, {IP: "192.168.1.9"}, {IP: "10.0.0.0/8"}}
+  if !sortClients(clients, "ip") {
+    t.Fatal("sortClients did not recognize ip")
+  }
+
+  var got []string
+  for _, client := range clients {
+    got = append(got, client.IP)
+  }
+  want := []string{"10.0.0.0/8", "192.168.1.9", "192.168.1.100", "2001:db8::1", "laptop"}
+  if !slices.Equal(got, want) {
+    t.Errorf("sorted = %v, want %v", got, want)
+  }
+
+  if sortClients(clients, "country") {
+    t.Error("sortClients accepted an unknown key")
+  }
+}
+
+func TestDisplayName(t *testing.T) {
+  useDefaultConfig(t)
+
+  for _, tc := range []struct {
+    client Client
+    want   string
+  }{
+    {Client{Name: "laptop", Source: "rdns"}, "laptop"},
+    {Client{Source: "arp"}, "(unnamed, ARP)"},
+    {Client{}, "(unnamed)"},
+  } {
+    if got := displayName(tc.client); got != tc.want {
+      t.Errorf("displayName(%+v) = %q, want %q", tc.client, got, tc.want)
+    }
+  }
+}
+
+func clientIPs(clients []Client) []string {
+  ips := make([]string, 0, len(clients))
+  for _, client := range clients {
+    ips = append(ips, client.IP)
+  }
+  return ips
+}
+
+func TestVisibleClientsFilters(t *testing.T) {
+  response := &ClientsResponse{
+    Clients: []Client{{IP: "192.168.1.10", Name: "laptop"}},
+    AutoClients: []Client{
+      {IP: "192.168.1.20", Name: "phone"},
+      {IP: "10.0.0.5", Name: "iot-camera"},
+      {IP: "2001:db8::1"},
+    },
+  }
+
+  for _, tc := range []struct {
+    hide, only []string
+    want       []string
+  }{
+    {nil, nil, []string{"192.168.1.10", "192.168.1.20", "10.0.0.5", "2001:db8::1"}},
+    {[]string{"10.0.0.0/8", "2001:db8::1"}, nil, []string{"192.168.1.10", "192.168.1.20"}},
+    {[]string{"iot-*", "192.168.1.2?"}, nil, []string{"192.168.1.10", "2001:db8::1"}},
+    {[]string{"phone"}, []string{"192.168.1.0/24"}, []string{"192.168.1.10"}},
+  } {
+    config := &Config{}
+    config.Display.HideClients = tc.hide
+    config.Display.OnlyClients = tc.only
+
+    if got := clientIPs(visibleClients(config, response)); !slices.Equal(got, tc.want) {
+      t.Errorf("hide %v, only %v: visible = %v, want %v", tc.hide, tc.only, got, tc.want)
+    }
+  }
+
+  visible := visibleClients(&Config{}, response)
+  if visible[0].Type != clientTypeConfigured || visible[1].Type != clientTypeAuto {
+    t.Errorf("types = %s, %s; want configured, auto", visible[0].Type, visible[1].Type)
+  }
+}
+
+func TestFetchLimitsResponseSize(t *testing.T) {
+  newFakeAdGuard(t, "  max_response_bytes: 100\n", nil)
+
+  _, err := fetchStats(t.Context(), currentConfig(), nil)
+  if !errors.Is(err, errResponseTooLarge) {
+    t.Errorf("error = %v, want errResponseTooLarge", err)
+  }
+
+  // A body of exactly the limit still decodes
+  newFakeAdGuard(t, fmt.Sprintf("  max_response_bytes: %d\n", len(testClientsJSON)), nil)
+  if _, err := fetchClients(t.Context(), currentConfig()); err != nil {
+    t.Errorf("fetchClients at the limit: %v", err)
+  }
+
+  config := &Config{}
+  config.AdGuard.MaxResponseBytes = -1
+  if err := validateConfig(config); err == nil {
+    t.Error("validateConfig accepted a negative max_response_bytes")
+  }
+}
+
+func TestAPIBasePath(t *testing.T) {
+  for _, tc := range []struct{ setting, want string }{
+    {"", "/control"},
+    {"/adguard/control", "/adguard/control"},
+    {"adguard/control/", "/adguard/control"},
+    {"/", ""},
+  } {
+    config := &Config{}
+    config.AdGuard.APIBasePath = tc.setting
+    if got := config.apiBasePath(); got != tc.want {
+      t.Errorf("apiBasePath(%q) = %q, want %q", tc.setting, got, tc.want)
+    }
+  }
+
+  f := newFakeAdGuard(t, "  api_base_path: \"adguard/control/\"\n", map[string]http.HandlerFunc{
+    "/adguard/control/stats": jsonHandler(testStatsJSON),
+  })
+  if _, err := fetchStats(t.Context(), currentConfig(), nil); err != nil {
+    t.Fatalf("fetchStats: %v", err)
+  }
+  if got := f.lastRequest(t).URL.Path; got != "/adguard/control/stats" {
+    t.Errorf("path = %s, want /adguard/control/stats", got)
+  }
+}
+
+func TestFetchRejectsNonJSON(t *testing.T) {
+  newFakeAdGuard(t, "", map[string]http.HandlerFunc{
+    "/control/clients": func(w http.ResponseWriter, r *http.Request) {
+      w.Write([]byte("<html>Please log in</html>"))
+    },
+  })
+
+  _, err := fetchClients(t.Context(), currentConfig())
+  if err == nil || !strings.Contains(err.Error(), "not valid JSON") || !strings.Contains(err.Error(), "Please log in") {
+    t.Errorf("error = %v, want a not valid JSON error quoting the body", err)
+  }
+}
+
+func TestBasicAuthSpecialCharacters(t *testing.T) {
+  f := newFakeAdGuard(t, "", nil)
+  useConfig(t, "adguard:\n  server_url: \""+f.URL+"\"\n  username: \"ädmin@home\"\n  password: 'p@ss:wörd \"%20'\n")
+
+  if _, err := fetchClients(t.Context(), currentConfig()); err != nil {
+    t.Fatalf("fetchClients: %v", err)
+  }
+  username, password, ok := f.lastRequest(t).BasicAuth()
+  if !ok || username != "ädmin@home" || password != `p@ss:wörd "%20` {
+    t.Errorf("basic auth = %q, %q, %v; want the configured credentials", username, password, ok)
+  }
+
+  config := &Config{}
+  config.AdGuard.Username = "ad:min"
+  if err := validateConfig(config); err == nil {
+    t.Error("validateConfig accepted a username with a colon")
+  }
+}
+
+func TestStatsResponsePartialFields(t *testing.T) {
+  var stats StatsResponse
+  err := json.Unmarshal([]byte(`{
+    "num_dns_queries": 42,
+    "top_clients": null,
+    "top_upstreams_avg_time": {"1.1.1.1:53": 0.01},
+    "dns_queries": "not a list",
+    "unknown_field": true
+  }`), &stats)
+  if err != nil {
+    t.Fatalf("Unmarshal: %v", err)
+  }
+
+  if stats.NumDNSQueries != 42 || stats.TopClients != nil || stats.TimeUnits != "" {
+    t.Errorf("stats = %+v, want the valid field decoded and the rest zero", stats)
+  }
+  if want := []string{"top_upstreams_avg_time", "dns_queries"}; !slices.Equal(slices.Sorted(slices.Values(stats.Skipped)), slices.Sorted(slices.Values(want))) {
+    t.Errorf("skipped = %v, want %v", stats.Skipped, want)
+  }
+
+  if html := generateSkippedFieldsNotice(stats.Skipped); !strings.Contains(html, "dns_queries") {
+    t.Errorf("notice does not name the skipped fields:\n%s", html)
+  }
+
+  if err := json.Unmarshal([]byte(`[1, 2]`), &StatsResponse{}); err == nil {
+    t.Error("Unmarshal accepted a response that is not an object")
+  }
+}
+
+func TestStaticAssets(t *testing.T) {
+  e := echo.New()
+  registerAssets(e.Group("/aghamon"))
+
+  get := func(target, etag string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(http.MethodGet, target, nil)
+    if etag != "" {
+      req.Header.Set("If-None-Match", etag)
+    }
+    rec := httptest.NewRecorder()
+    e.ServeHTTP(rec, req)
+    return rec
+  }
+
+  rec := get("/aghamon/static/live.js", "")
+  if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Type"), "javascript") {
+    t.Fatalf("live.js: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+  }
+  etag := rec.Header().Get("ETag")
+  if etag == "" || !strings.HasPrefix(rec.Header().Get("Cache-Control"), "public, max-age=") {
+    t.Errorf("live.js cache headers: ETag %q, Cache-Control %q", etag, rec.Header().Get("Cache-Control"))
+  }
+  if rec := get("/aghamon/static/live.js", etag); rec.Code != http.StatusNotModified {
+    t.Errorf("live.js with a matching If-None-Match: %d, want 304", rec.Code)
+  }
+
+  if rec := get("/aghamon/favicon.ico", ""); rec.Code != http.StatusOK || rec.Header().Get("ETag") == "" {
+    t.Errorf("favicon.ico: %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+  }
+  for _, target := range []string{"/aghamon/static/missing.js", "/aghamon/static/../main.go", "/aghamon/static/%2e%2e/main.go"} {
+    if rec := get(target, ""); rec.Code != http.StatusNotFound {
+      t.Errorf("%s: %d, want 404", target, rec.Code)
+    }
+  }
+}
+
+func TestEnrichWhoisCachesLookups(t *testing.T) {
+  useDefaultConfig(t)
+  lookups := make(map[string]int)
+  whoisSource = func(ip string) (WhoisInfo, error) {
+    lookups[ip]++
+    if ip == "10.0.0.1" {
+      return WhoisInfo{}, errors.New("lookup failed")
+    }
+    return WhoisInfo{Country: "DE", OrgName: "Example GmbH"}, nil
+  }
+  t.Cleanup(func() { whoisSource = nil })
+
+  for range 3 {
+    clients := []Client{
+      {IP: "192.168.1.10"},
+      {IP: "10.0.0.1"},
+      {IP: "192.168.1.20", WhoisInfo: WhoisInfo{Country: "US"}},
+    }
+    enrichWhois(clients)
+
+    if clients[0].WhoisInfo.Country != "DE" || clients[1].WhoisInfo != (WhoisInfo{}) || clients[2].WhoisInfo.Country != "US" {
+      t.Fatalf("whois = %+v, %+v, %+v", clients[0].WhoisInfo, clients[1].WhoisInfo, clients[2].WhoisInfo)
+    }
+  }
+
+  if lookups["192.168.1.10"] != 1 || lookups["10.0.0.1"] != 1 || lookups["192.168.1.20"] != 0 {
+    t.Errorf("lookups = %v, want one per IP without whois info, failures included", lookups)
+  }
+}
+
+func TestEmptyWhoisFieldsShowDash(t *testing.T) {
+  useDefaultConfig(t)
+  clients := []Client{
+    {IP: "192.168.1.10", WhoisInfo: WhoisInfo{Country: "US"}},
+    {IP: "192.168.1.20", WhoisInfo: WhoisInfo{OrgName: "Org", City: "NYC"}},
+  }
+
+  html := generateHTMLTable(clients, []string{"country", "organization", "city"}, nil, nil, 100, false, false)
+  for _, want := range []string{">US</td>", ">Org</td>", ">NYC</td>"} {
+    if !strings.Contains(html, want) {
+      t.Errorf("table has no %q:\n%s", want, html)
+    }
+  }
+  if got := strings.Count(html, ">—</td>"); got != 3 {
+    t.Errorf("table has %d dashes, want 3 (organization and city, then country):\n%s", got, html)
+  }
+}
+
+// compressedHandler answers with body compressed in the given Content-Encoding
+func compressedHandler(t *testing.T, encoding, body string) http.HandlerFunc {
+  var buf bytes.Buffer
+  var w io.WriteCloser
+  if encoding == "gzip" {
+    w = gzip.NewWriter(&buf)
+  } else {
+    w = zlib.NewWriter(&buf)
+  }
+  if _, err := io.WriteString(w, body); err != nil {
+    t.Fatal(err)
+  }
+  w.Close()
+
+  return func(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+    rw.Header().Set("Content-Encoding", encoding)
+    rw.Write(buf.Bytes())
+  }
+}
+
+func TestFetchDecodesCompressedResponses(t *testing.T) {
+  for _, encoding := range []string{"gzip", "deflate"} {
+    f := newFakeAdGuard(t, "", map[string]http.HandlerFunc{"/control/stats": compressedHandler(t, encoding, testStatsJSON)})
+
+    stats, err := fetchStats(t.Context(), currentConfig(), nil)
+    if err != nil {
+      t.Errorf("%s: fetchStats: %v", encoding, err)
+      continue
+    }
+    if stats.NumDNSQueries != 3000 {
+      t.Errorf("%s: num_dns_queries = %d, want 3000", encoding, stats.NumDNSQueries)
+    }
+    if got := f.lastRequest(t).Header.Get("Accept-Encoding"); got != "gzip, deflate" {
+      t.Errorf("%s: Accept-Encoding = %q, want gzip, deflate", encoding, got)
+    }
+  }
+
+  // The size limit applies to the decompressed body, so a small compressed response can't expand unchecked
+  newFakeAdGuard(t, "  max_response_bytes: 1000\n", map[string]http.HandlerFunc{
+    "/control/stats": compressedHandler(t, "gzip", `{"top_clients": [`+strings.Repeat(`{"192.168.1.10": 1},`, 1000)+`{}]}`),
+  })
+  if _, err := fetchStats(t.Context(), currentConfig(), nil); !errors.Is(err, errResponseTooLarge) {
+    t.Errorf("compressed response over the limit: error = %v, want errResponseTooLarge", err)
+  }
+}
+
+// countingTransport answers every request with an empty 200 and tracks how many responses are
+// open, from the request until the body is closed
+type countingTransport struct {
+  mu      sync.Mutex
+  open    int
+  maxOpen int
+  err     error
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+  if t.err != nil {
+    return nil, t.err
+  }
+
+  t.mu.Lock()
+  t.open++
+  t.maxOpen = max(t.maxOpen, t.open)
+  t.mu.Unlock()
+
+  body := &closeFunc{ReadCloser: io.NopCloser(strings.NewReader("{}")), close: func() {
+    t.mu.Lock()
+    t.open--
+    t.mu.Unlock()
+  }}
+  return &http.Response{StatusCode: http.StatusOK, Body: body, Request: req}, nil
+}
+
+// closeFunc is a body that calls close the first time it is closed
+type closeFunc struct {
+  io.ReadCloser
+  close func()
+  once  sync.Once
+}
+
+// Close implements io.Closer
+func (b *closeFunc) Close() error {
+  b.once.Do(b.close)
+  return b.ReadCloser.Close()
+}
+
+func TestLimitedTransportHoldsSlotUntilBodyClosed(t *testing.T) {
+  const limit = 2
+  base := &countingTransport{}
+  client := &http.Client{Transport: &limitedTransport{base: base, slots: semaphore.NewWeighted(limit)}}
+
+  var wg sync.WaitGroup
+  for range 8 {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      resp, err := client.Get("http://adguard.test/control/stats")
+      if err != nil {
+        t.Error(err)
+        return
+      }
+      // Reading the body is part of the fetch, so the slot must still be taken meanwhile
+      time.Sleep(10 * time.Millisecond)
+      io.Copy(io.Discard, resp.Body)
+      resp.Body.Close()
+      resp.Body.Close()
+    }()
+  }
+  wg.Wait()
+
+  if base.maxOpen > limit {
+    t.Errorf("%d responses were open at once, want at most %d", base.maxOpen, limit)
+  }
+  if base.open != 0 {
+    t.Errorf("%d responses still open", base.open)
+  }
+}
+
+func TestLimitedTransportReleasesSlotOnError(t *testing.T) {
+  slots := semaphore.NewWeighted(1)
+  client := &http.Client{Transport: &limitedTransport{base: &countingTransport{err: errors.New("connection refused")}, slots: slots}}
+
+  for range 2 {
+    if _, err := client.Get("http://adguard.test/control/stats"); err == nil {
+      t.Fatal("Get succeeded, want the transport error")
+    }
+  }
+  if !slots.TryAcquire(1) {
+    t.Error("the slot was not released after the failed request")
+  }
+}
+
+func TestLimitedTransportWaiterGivesUpWhenCanceled(t *testing.T) {
+  release := make(chan struct{})
+  f := newFakeAdGuard(t, "  max_concurrent_fetches: 1\n", map[string]http.HandlerFunc{
+    "/control/stats": func(w http.ResponseWriter, r *http.Request) {
+      <-release
+      jsonHandler(testStatsJSON)(w, r)
+    },
+  })
+
+  // The first fetch takes the only slot until AdGuard Home answers
+  done := make(chan error)
+  go func() {
+    _, err := fetchStats(t.Context(), currentConfig(), nil)
+    done <- err
+  }()
+  for !slices.Contains(f.requestPaths(), "/control/stats") {
+    time.Sleep(time.Millisecond)
+  }
+
+  ctx, cancel := context.WithCancel(t.Context())
+  time.AfterFunc(20*time.Millisecond, cancel)
+  if _, err := fetchClients(ctx, currentConfig()); !errors.Is(err, context.Canceled) {
+    t.Errorf("waiting fetchClients error %v, want context.Canceled", err)
+  }
+  if paths := f.requestPaths(); slices.Contains(paths, "/control/clients") {
+    t.Errorf("the canceled waiter reached AdGuard Home: %v", paths)
+  }
+  if status := breaker.status(time.Minute); status.Failures != 0 {
+    t.Errorf("breaker failures %d after a canceled waiter, want 0", status.Failures)
+  }
+
+  close(release)
+  if err := <-done; err != nil {
+    t.Errorf("fetchStats holding the slot: %v", err)
+  }
+}
+
+func TestAnonymizeIP(t *testing.T) {
+  for _, tc := range []struct{ in, want string }{
+    {"192.168.1.123", "192.168.1.0"},
+    {"::ffff:10.0.0.7", "10.0.0.0"},
+    {"10.1.2.3/32", "10.1.2.0"},
+    {"10.0.0.0/8", "10.0.0.0/8"},
+    {"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+    {"fe80::1%eth0", "fe80::/64"},
+    {"2001:db8::/48", "2001:db8::/48"},
+    {"laptop", "laptop"},
+  } {
+    if got := anonymizeIP(tc.in); got != tc.want {
+      t.Errorf("anonymizeIP(%q) = %q, want %q", tc.in, got, tc.want)
+    }
+  }
+}
+
+func TestFetchWithoutCredentials(t *testing.T) {
+  f := newFakeAdGuard(t, "", nil)
+  useConfig(t, "adguard:\n  server_url: \""+f.URL+"\"\n")
+
+  if _, err := fetchClients(t.Context(), currentConfig()); err != nil {
+    t.Fatalf("fetchClients: %v", err)
+  }
+  req := f.lastRequest(t)
+  if got, ok := req.Header["Authorization"]; ok {
+    t.Errorf("Authorization = %q, want none without credentials", got)
+  }
+  if got := req.Header.Get("Referer"); got != f.URL+"/" {
+    t.Errorf("Referer = %q, want the other headers still sent", got)
+  }
+}
+
+func TestFetchOverUnixSocket(t *testing.T) {
+  // Socket paths are limited to about 100 bytes, which t.TempDir can exceed
+  dir, err := os.MkdirTemp("", "aghamon")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { os.RemoveAll(dir) })
+  socket := filepath.Join(dir, "adguard.sock")
+
+  listener, err := net.Listen("unix", socket)
+  if err != nil {
+    t.Skipf("Unix domain sockets unavailable: %v", err)
+  }
+  server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: jsonHandler(testStatsJSON)}}
+  server.Start()
+  t.Cleanup(server.Close)
+
+  useConfig(t, "adguard:\n  server_url: \"unix://"+socket+"\"\n")
+  stats, err := fetchStats(t.Context(), currentConfig(), nil)
+  if err != nil {
+    t.Fatalf("fetchStats: %v", err)
+  }
+  if stats.NumDNSQueries != 3000 {
+    t.Errorf("num_dns_queries = %d, want 3000", stats.NumDNSQueries)
+  }
+
+  if _, err := parseConfig(strings.NewReader("adguard:\n  server_url: \"unix://adguard.sock\"\n")); err == nil {
+    t.Error("parseConfig accepted a relative socket path")
+  }
+}
+
+func TestFetchReusesConnections(t *testing.T) {
+  f := newFakeAdGuard(t, "", nil)
+
+  for range 5 {
+    if _, err := fetchStats(t.Context(), currentConfig(), nil); err != nil {
+      t.Fatalf("fetchStats: %v", err)
+    }
+  }
+  if n := f.conns.Load(); n != 1 {
+    t.Errorf("%d connections for 5 sequential fetches, want 1", n)
+  }
+}
+
+func BenchmarkFetchStats(b *testing.B) {
+  f := newFakeAdGuard(b, "", nil)
+  config := currentConfig()
+
+  b.ReportAllocs()
+  for b.Loop() {
+    if _, err := fetchStats(b.Context(), config, nil); err != nil {
+      b.Fatal(err)
+    }
+  }
+  b.ReportMetric(float64(f.conns.Load()), "conns")
+}
+
+func BenchmarkGenerateStatsPage(b *testing.B) {
+  useDefaultConfig(b)
+  var stats StatsResponse
+  if err := json.Unmarshal([]byte(testStatsJSON), &stats); err != nil {
+    b.Fatal(err)
+  }
+
+  b.ReportAllocs()
+  for b.Loop() {
+    generateStatsTable("Top Queried Domains", stats.TopQueriedDomains, "Count", 10, defaultMaxRows)
+    generateStatsTable("Top Clients", stats.TopClients, "Count", 10, defaultMaxRows)
+    generateUpstreamsTable("Upstreams", mergeUpstreams(&stats), url.Values{}, defaultUpstreamSort, true, 10, defaultMaxRows)
+  }
+}
+
+// upstreamNames returns the names of upstreams in order
+func upstreamNames(upstreams []UpstreamStat) []string {
+  names := make([]string, 0, len(upstreams))
+  for _, upstream := range upstreams {
+    names = append(names, upstream.Upstream)
+  }
+  return names
+}
+
+func TestSortUpstreams(t *testing.T) {
+  var stats StatsResponse
+  if err := json.Unmarshal([]byte(testStatsJSON), &stats); err != nil {
+    t.Fatal(err)
+  }
+  // An upstream with a time but no count, as when the two top lists differ
+  stats.TopUpstreamsAvgTime = append(stats.TopUpstreamsAvgTime, map[string]float64{"9.9.9.9:53": 0.001})
+
+  for _, tc := range []struct {
+    key, order string
+    want       []string
+  }{
+    {"count", "", []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"}},
+    {"count", "asc", []string{"8.8.8.8:53", "1.1.1.1:53", "9.9.9.9:53"}},
+    {"time", "", []string{"9.9.9.9:53", "1.1.1.1:53", "8.8.8.8:53"}},
+    {"time", "desc", []string{"8.8.8.8:53", "1.1.1.1:53", "9.9.9.9:53"}},
+  } {
+    upstreams := mergeUpstreams(&stats)
+    if !sortUpstreams(upstreams, tc.key, upstreamSortDesc(tc.key, tc.order)) {
+      t.Fatalf("sortUpstreams did not recognize %s", tc.key)
+    }
+    if got := upstreamNames(upstreams); !slices.Equal(got, tc.want) {
+      t.Errorf("sort=%s&order=%s: %v, want %v", tc.key, tc.order, got, tc.want)
+    }
+  }
+
+  if sortUpstreams(mergeUpstreams(&stats), "name", false) {
+    t.Error("sortUpstreams accepted an unknown key")
+  }
+}
+
+func TestUpstreamsTableSharesAndSortLinks(t *testing.T) {
+  useDefaultConfig(t)
+  var stats StatsResponse
+  if err := json.Unmarshal([]byte(testStatsJSON), &stats); err != nil {
+    t.Fatal(err)
+  }
+
+  // Shares are of every response, also those of upstreams beyond the limit
+  html := generateUpstreamsTable("Upstreams", mergeUpstreams(&stats), url.Values{"top": {"1"}}, "count", true, 1, 10)
+  if !strings.Contains(html, "75.0%") || strings.Contains(html, "8.8.8.8:53") {
+    t.Errorf("table does not show the top upstream with a 75%% share:\n%s", html)
+  }
+  if !strings.Contains(html, `href="/upstreams?order=asc&amp;sort=count&amp;top=1">Count &#9660;</a>`) {
+    t.Errorf("sorted column does not link to the reverse order:\n%s", html)
+  }
+  if !strings.Contains(html, `href="/upstreams?sort=time&amp;top=1">Avg Time</a>`) {
+    t.Errorf("other column does not link to its default order:\n%s", html)
+  }
+}
+
+func TestSourceLabels(t *testing.T) {
+  config := useConfig(t, "adguard:\n  server_url: \"http://127.0.0.1:1\"\ndisplay:\n  source_labels:\n    RDNS: \"Reverse lookup\"\n    custom: \"Custom source\"\n")
+
+  for _, tc := range []struct{ source, want string }{
+    {"rdns", "Reverse lookup"},
+    {"ARP", "ARP"},
+    {"etc/hosts", "Hosts file"},
+    {"custom", "Custom source"},
+    {"unknown_source", "unknown_source"},
+  } {
+    if got := config.sourceLabel(tc.source); got != tc.want {
+      t.Errorf("sourceLabel(%q) = %q, want %q", tc.source, got, tc.want)
+    }
+  }
+
+  if got := generateClientCell(Client{Source: "rdns"}, "source", nil, false); !strings.Contains(got, ">Reverse lookup<") {
+    t.Errorf("source cell = %s, want the configured label", got)
+  }
+
+  if _, err := parseConfig(strings.NewReader("adguard:\n  server_url: \"http://127.0.0.1:1\"\ndisplay:\n  source_labels:\n    arp: \" \"\n")); err == nil {
+    t.Error("parseConfig accepted an empty label")
+  }
+}
+
+func TestReconcileQueries(t *testing.T) {
+  useDefaultConfig(t)
+
+  for _, tc := range []struct {
+    name     string
+    stats    StatsResponse
+    sum      int
+    diff     float64
+    mismatch bool
+  }{
+    {"matching", StatsResponse{NumDNSQueries: 60, DNSQueries: []int{10, 20, 30}}, 60, 0, false},
+    {"within the threshold", StatsResponse{NumDNSQueries: 1000, DNSQueries: []int{500, 495}}, 995, 0.5, false},
+    {"above the threshold", StatsResponse{NumDNSQueries: 1000, DNSQueries: []int{500, 400}}, 900, 10, true},
+    {"series without a total", StatsResponse{DNSQueries: []int{5}}, 5, 100, true},
+  } {
+    r, ok := reconcileQueries(&tc.stats, 1)
+    if !ok || r.SeriesSum != tc.sum || r.DiffPercent != tc.diff || r.Mismatch != tc.mismatch {
+      t.Errorf("%s: %+v, %v; want sum %d, %v%%, mismatch %v", tc.name, r, ok, tc.sum, tc.diff, tc.mismatch)
+    }
+  }
+
+  if _, ok := reconcileQueries(&StatsResponse{NumDNSQueries: 10}, 1); ok {
+    t.Error("reconcileQueries compared a response without a series")
+  }
+
+  r, ok := reconcileQueries(&StatsResponse{NumDNSQueries: 1000, DNSQueries: []int{500, 400}}, 1)
+  if html := generateQueryReconciliation(r, ok); !strings.Contains(html, "stats-mismatch") || !strings.Contains(html, "10.0%") {
+    t.Errorf("mismatch is not flagged:\n%s", html)
+  }
+}
+
+func TestFetchWithToken(t *testing.T) {
+  for _, tc := range []struct {
+    options, header, want string
+  }{
+    {"  auth: \"token\"\n  token: \"s3cret\"\n", "Authorization", "Bearer s3cret"},
+    {"  auth: \"token\"\n  token: \"s3cret\"\n  token_header: \"X-Api-Key\"\n", "X-Api-Key", "s3cret"},
+  } {
+    // The username and password are set too; with token auth they must not be sent
+    f := newFakeAdGuard(t, tc.options, nil)
+
+    if _, err := fetchClients(t.Context(), currentConfig()); err != nil {
+      t.Fatalf("fetchClients: %v", err)
+    }
+    req := f.lastRequest(t)
+    if got := req.Header.Get(tc.header); got != tc.want {
+      t.Errorf("%s = %q, want %q", tc.header, got, tc.want)
+    }
+    if _, _, ok := req.BasicAuth(); ok {
+      t.Errorf("%s: basic auth sent with token auth", tc.header)
+    }
+  }
+
+  for _, options := range []string{"  auth: \"token\"\n", "  auth: \"oauth\"\n  token: \"s3cret\"\n", "  auth: \"token\"\n  token: \"a\\nb\"\n"} {
+    if _, err := parseConfig(strings.NewReader("adguard:\n  server_url: \"http://127.0.0.1:1\"\n" + options)); err == nil {
+      t.Errorf("parseConfig accepted %q", options)
+    }
+  }
+}
+
+func TestFormatStatsPeriod(t *testing.T) {
+  useDefaultConfig(t)
+
+  for _, tc := range []struct {
+    units  string
+    series int
+    want   string
+  }{
+    {"hours", 24, "24 hours"},
+    {"hours", 1, "1 hour"},
+    {"days", 7, "7 days"},
+    {"days", 1, "1 day"},
+    {"Days ", 90, "90 days"},
+    {"", 0, "24 hours"},
+    {"hours", 2160, "2,160 hours"},
+  } {
+    stats := &StatsResponse{TimeUnits: tc.units, DNSQueries: make([]int, tc.series)}
+    if got := formatStatsPeriod(stats); got != tc.want {
+      t.Errorf("%q with %d entries: %q, want %q", tc.units, tc.series, got, tc.want)
+    }
+  }
+}
+
+func TestPinnedClientsLead(t *testing.T) {
+  config := useConfig(t, "adguard:\n  server_url: \"http://127.0.0.1:1\"\ndisplay:\n  pinned_clients: [\"192.168.1.50\", \"2001:db8:0::1\"]\n")
+  pinned := pinnedClientSet(config)
+
+  clients := []Client{
+    {IP: "192.168.1.50", Name: "zeta"},
+    {IP: "192.168.1.2", Name: "beta"},
+    {IP: "2001:db8::1", Name: "alpha"},
+    {IP: "192.168.1.1", Name: "gamma"},
+    {IP: "10.0.0.1", Name: "delta"},
+  }
+
+  for _, tc := range []struct {
+    sort string
+    want []string
+  }{
+    {"ip", []string{"192.168.1.50", "2001:db8::1", "10.0.0.1", "192.168.1.1", "192.168.1.2"}},
+    {"name", []string{"2001:db8::1", "192.168.1.50", "192.168.1.2", "10.0.0.1", "192.168.1.1"}},
+  } {
+    sorted := slices.Clone(clients)
+    sortClients(sorted, tc.sort)
+    pinClients(sorted, pinned)
+    if got := clientIPs(sorted); !slices.Equal(got, tc.want) {
+      t.Errorf("sort=%s: %v, want %v", tc.sort, got, tc.want)
+    }
+
+    // The pinned clients fill the first page, and only that page, like any other client
+    first := paginate(len(sorted), 1, 2)
+    second := paginate(len(sorted), 2, 2)
+    if got := clientIPs(sorted[first.Start:first.End]); !slices.Equal(got, tc.want[:2]) {
+      t.Errorf("sort=%s: first page %v, want the pinned clients", tc.sort, got)
+    }
+    html := generateHTMLTable(sorted[second.Start:second.End], defaultClientColumns, nil, pinned, 100, false, false)
+    if strings.Contains(html, "pinned-client") {
+      t.Errorf("sort=%s: second page marks a client as pinned:\n%s", tc.sort, html)
+    }
+  }
+
+  html := generateHTMLTable(clients[:2], defaultClientColumns, nil, pinned, 100, false, false)
+  if strings.Count(html, `class="pinned-client"`) != 1 {
+    t.Errorf("want exactly the pinned row marked:\n%s", html)
+  }
+}
+
+// xssDomain is a domain name a client could look up to get markup into a page
+const xssDomain = `<script>alert("x")</script>.example`
+
+// assertEscaped fails unless html contains xssDomain only in escaped form
+func assertEscaped(t *testing.T, html string) {
+  t.Helper()
+  if strings.Contains(html, "<script>") {
+    t.Errorf("output contains unescaped markup:\n%s", html)
+  }
+  if !strings.Contains(html, "&lt;script&gt;") {
+    t.Errorf("output is missing the escaped name:\n%s", html)
+  }
+}
+
+func TestClientStatsEscapesDomains(t *testing.T) {
+  useDefaultConfig(t)
+
+  html := generateClientStats(&ClientStats{
+    Sampled:    3,
+    Blocked:    1,
+    TopDomains: []map[string]int{{xssDomain: 2}, {"example.com": 1}},
+  }, 10, 100)
+  assertEscaped(t, html)
+}
+
+func TestBlockedClientsTableEscapesNames(t *testing.T) {
+  useDefaultConfig(t)
+
+  html := generateBlockedClientsTable([]map[string]int{{xssDomain: 5}, {"192.168.1.10": 2}}, 7, 10, 10)
+  assertEscaped(t, html)
+}
+
+func TestGroupedStatsTableEscapesDomains(t *testing.T) {
+  useDefaultConfig(t)
+
+  data := []map[string]int{{xssDomain: 5}, {"ads.example": 3}, {"other.example": 1}}
+  categories := map[string]string{xssDomain: "Ads", "ads.example": "Ads"}
+  html := generateGroupedStatsTable("Top Blocked Domains", data, categories, "Count", 10, 10)
+  assertEscaped(t, html)
+
+  if !strings.Contains(html, uncategorizedGroup) {
+    t.Errorf("output is missing the %q group:\n%s", uncategorizedGroup, html)
+  }
+}
+
+func TestQueryTypesTableEscapesTypes(t *testing.T) {
+  useDefaultConfig(t)
+
+  if html := generateQueryTypesTable(nil, 0, 10); html != "" {
+    t.Errorf("empty counts rendered %q, want nothing", html)
+  }
+
+  html := generateQueryTypesTable(map[string]int{"A": 10, "AAAA": 4, xssDomain: 1}, 15, 10)
+  assertEscaped(t, html)
+  a, aaaa := strings.Index(html, "<td>A</td>"), strings.Index(html, "<td>AAAA</td>")
+  if a < 0 || aaaa < 0 || a > aaaa {
+    t.Errorf("types are not ordered by count:\n%s", html)
+  }
+}
+
+func TestUpstreamsTableEscapesNames(t *testing.T) {
+  useDefaultConfig(t)
+
+  count, avg := 5, 12.5
+  upstreams := []UpstreamStat{{Upstream: xssDomain, Count: &count, AvgTimeMs: &avg}, {Upstream: "1.1.1.1:53"}}
+  html := generateUpstreamsTable("Upstreams", upstreams, url.Values{}, defaultUpstreamSort, true, 10, 10)
+  assertEscaped(t, html)
+}
+
+func TestRewritesDeleteConfirmationEscapesQuotes(t *testing.T) {
+  useDefaultConfig(t)
+
+  rewrites := []Rewrite{{Domain: `x" onmouseover="alert(1)`, Answer: "1.2.3.4"}}
+  html := generateRewritesContent(rewrites, "/rewrites", "token", 10)
+  if strings.Contains(html, `" onmouseover=`) {
+    t.Errorf("the domain breaks out of the onsubmit attribute:\n%s", html)
+  }
+  if !strings.Contains(html, `Delete the rewrite x\&#34; onmouseover\u003D\&#34;alert(1)`) {
+    t.Errorf("output is missing the escaped confirmation:\n%s", html)
+  }
+}
+
+func TestQueryLogRowEscapesUnparsableTime(t *testing.T) {
+  useDefaultConfig(t)
+
+  html := generateQueryLogRow(QueryLogEntry{Time: xssDomain, Client: "192.168.1.10"}, time.UTC, false)
+  assertEscaped(t, html)
+}
+
+func TestFiltersTableEscapesUnparsableLastUpdated(t *testing.T) {
+  useDefaultConfig(t)
+
+  filters := []Filter{{Name: "List", URL: "https://example.com/list.txt", LastUpdated: xssDomain}}
+  html := generateFiltersTable("Blocklists", filters, false, time.UTC, "", "", 10)
+  assertEscaped(t, html)
+}
+
+func TestClientCellAnonymizedHidesAddress(t *testing.T) {
+  useDefaultConfig(t)
+
+  for _, ip := range []string{"192.168.1.123", "2001:db8:1:2:3:4:5:6"} {
+    client := Client{IP: ip}
+
+    html := generateClientCell(client, "ip", nil, true)
+    if strings.Contains(html, ip) || strings.Contains(html, url.PathEscape(ip)) || strings.Contains(html, "href") {
+      t.Errorf("anonymized cell reveals %s:\n%s", ip, html)
+    }
+    if !strings.Contains(html, anonymizeIP(ip)) {
+      t.Errorf("anonymized cell is missing %s:\n%s", anonymizeIP(ip), html)
+    }
+
+    if html := generateClientCell(client, "ip", nil, false); !strings.Contains(html, `href="/clients/`+url.PathEscape(ip)+`"`) {
+      t.Errorf("cell does not link to the client page:\n%s", html)
+    }
+  }
+}
+
+func TestAnonymizeRequested(t *testing.T) {
+  e := echo.New()
+  for _, tc := range []struct {
+    setting bool
+    target  string
+    want    bool
+  }{
+    {false, "/api/clients", false},
+    {false, "/api/clients?anonymize=1", true},
+    {true, "/api/clients", true},
+    {true, "/api/stats?anonymize=0", true},
+  } {
+    config := useDefaultConfig(t)
+    config.Display.AnonymizeIPs = tc.setting
+    c := e.NewContext(httptest.NewRequest(http.MethodGet, tc.target, nil), httptest.NewRecorder())
+
+    if got := anonymizeRequested(c, config); got != tc.want {
+      t.Errorf("anonymize_ips %v, %s: anonymizeRequested = %v, want %v", tc.setting, tc.target, got, tc.want)
+    }
+  }
+}
+
+func TestAnonymizedStatsMasksTopClients(t *testing.T) {
+  stats := &StatsResponse{TopClients: []map[string]int{{"192.168.1.10": 150}, {"2001:db8:1:2::9": 50}}}
+
+  masked := anonymizedStats(stats)
+  if masked.TopClients[0]["192.168.1.0"] != 150 || masked.TopClients[1]["2001:db8:1:2::/64"] != 50 {
+    t.Errorf("top clients = %v, want masked IPs", masked.TopClients)
+  }
+  if stats.TopClients[0]["192.168.1.10"] != 150 {
+    t.Errorf("anonymizedStats changed the cached stats: %v", stats.TopClients)
+  }
+}
+
+func TestGetStatsInRange(t *testing.T) {
+  // The last three hours of the canned series, as a version that understands start and end sends them
+  ranged := jsonHandler(`{"time_units": "hours", "dns_queries": [220, 230, 240], "num_dns_queries": 690}`)
+  rejecting := func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Has("start") {
+      http.Error(w, "unknown parameter start", http.StatusBadRequest)
+      return
+    }
+    jsonHandler(testStatsJSON)(w, r)
+  }
+  honoring := func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Has("start") {
+      ranged(w, r)
+      return
+    }
+    jsonHandler(testStatsJSON)(w, r)
+  }
+
+  now := time.Now()
+  lastThreeHours := &StatsRange{From: now.Add(-3 * time.Hour), To: now}
+  dayBefore := &StatsRange{From: now.Add(-72 * time.Hour), To: now.Add(-48 * time.Hour)}
+
+  for _, tc := range []struct {
+    name    string
+    handler http.HandlerFunc
+    rng     *StatsRange
+    covered bool
+    queries int
+  }{
+    {"honored", honoring, lastThreeHours, true, 690},
+    {"rejected", rejecting, lastThreeHours, false, 3000},
+    {"ignored, shorter than the default window", jsonHandler(testStatsJSON), lastThreeHours, false, 3000},
+    {"ignored, as long as the default window", jsonHandler(testStatsJSON), dayBefore, false, 3000},
+  } {
+    newFakeAdGuard(t, "", map[string]http.HandlerFunc{"/control/stats": tc.handler})
+
+    stats, _, covered, err := getStatsInRange(t.Context(), currentConfig(), tc.rng)
+    if err != nil {
+      t.Errorf("%s: getStatsInRange: %v", tc.name, err)
+      continue
+    }
+    if covered != tc.covered || stats.NumDNSQueries != tc.queries {
+      t.Errorf("%s: covered %v with %d queries, want %v with %d", tc.name, covered, stats.NumDNSQueries, tc.covered, tc.queries)
+    }
+  }
+}
+
+func TestComparePeriods(t *testing.T) {
+  useDefaultConfig(t)
+
+  daily := &StatsResponse{TimeUnits: "days", DNSQueries: []int{500, 400, 100}, BlockedFiltering: []int{50, 40, 20}}
+  cmp, ok := comparePeriods(daily)
+  if !ok || cmp != (PeriodComparison{Queries: 100, Blocked: 20, PrevQueries: 400, PrevBlocked: 40}) {
+    t.Errorf("comparePeriods = %+v, %v; want the last two days", cmp, ok)
+  }
+
+  html := generateComparisonTable(cmp, ok)
+  if !strings.Contains(html, "Latest Day vs Previous Day") || strings.Contains(html, "Yesterday") {
+    t.Errorf("comparison is not labelled as the last two days of the series:\n%s", html)
+  }
+  if !strings.Contains(html, "-300 (-75.0%)") {
+    t.Errorf("comparison is missing the query change:\n%s", html)
+  }
+
+  if _, ok := comparePeriods(&StatsResponse{TimeUnits: "hours", DNSQueries: make([]int, 24), BlockedFiltering: make([]int, 24)}); ok {
+    t.Error("comparePeriods compared hourly statistics")
+  }
+  if _, ok := comparePeriods(&StatsResponse{TimeUnits: "days", DNSQueries: []int{1}, BlockedFiltering: []int{0}}); ok {
+    t.Error("comparePeriods compared a single day")
+  }
+}
+
+func TestComparePreviousDay(t *testing.T) {
+  // server.timezone defaults to UTC
+  now := time.Now().UTC()
+  midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+  hours := int(math.Ceil(now.Sub(midnight).Hours()))
+
+  // Today so far has one entry per hour since midnight, yesterday all 24
+  honoring := func(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Query().Get("start") {
+    case "":
+      jsonHandler(testStatsJSON)(w, r)
+    case strconv.FormatInt(midnight.UnixMilli(), 10):
+      json.NewEncoder(w).Encode(StatsResponse{TimeUnits: "hours", DNSQueries: make([]int, hours), NumDNSQueries: 100, NumBlockedFiltering: 20})
+    default:
+      json.NewEncoder(w).Encode(StatsResponse{TimeUnits: "hours", DNSQueries: make([]int, 24), NumDNSQueries: 400, NumBlockedFiltering: 40})
+    }
+  }
+  rejecting := func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Has("start") {
+      http.Error(w, "unknown parameter start", http.StatusBadRequest)
+      return
+    }
+    jsonHandler(testStatsJSON)(w, r)
+  }
+  daily := &StatsResponse{TimeUnits: "days", DNSQueries: []int{500, 300, 150}, BlockedFiltering: []int{50, 30, 15}}
+  hourly := &StatsResponse{TimeUnits: "hours", DNSQueries: make([]int, 24), BlockedFiltering: make([]int, 24)}
+
+  for _, tc := range []struct {
+    name    string
+    handler http.HandlerFunc
+    stats   *StatsResponse
+    ok      bool
+    want    PeriodComparison
+    heading string
+  }{
+    {"ranges", honoring, hourly, true, PeriodComparison{Queries: 100, Blocked: 20, PrevQueries: 400, PrevBlocked: 40, Ranged: true}, "Today vs Yesterday"},
+    {"no ranges, daily series", rejecting, daily, true, PeriodComparison{Queries: 150, Blocked: 15, PrevQueries: 300, PrevBlocked: 30}, "Latest Day vs Previous Day"},
+    {"no ranges, hourly series", rejecting, hourly, false, PeriodComparison{}, "needs AdGuard Home to return stats for a time range"},
+  } {
+    newFakeAdGuard(t, "", map[string]http.HandlerFunc{"/control/stats": tc.handler})
+
+    cmp, ok, err := comparePreviousDay(t.Context(), currentConfig(), tc.stats, now)
+    if err != nil {
+      t.Errorf("%s: comparePreviousDay: %v", tc.name, err)
+    }
+    if ok != tc.ok || cmp != tc.want {
+      t.Errorf("%s: comparePreviousDay = %+v, %v; want %+v, %v", tc.name, cmp, ok, tc.want, tc.ok)
+    }
+    if html := generateComparisonTable(cmp, ok); !strings.Contains(html, tc.heading) {
+      t.Errorf("%s: comparison is missing %q:\n%s", tc.name, tc.heading, html)
+    }
+  }
+}
+
+func TestPagesCarryNoIndex(t *testing.T) {
+  templates, err := template.ParseFS(templateFS, requiredTemplates...)
+  if err != nil {
+    t.Fatalf("ParseFS: %v", err)
+  }
+  e := echo.New()
+  e.Renderer = &Template{templates: templates}
+
+  for _, allow := range []bool{false, true} {
+    config := useConfig(t, "adguard:\n  server_url: \"http://127.0.0.1:1\"\nserver:\n  base_path: \"/aghamon\"\n")
+    config.Server.AllowIndexing = allow
+
+    rec := httptest.NewRecorder()
+    c := e.NewContext(httptest.NewRequest(http.MethodGet, "/aghamon/", nil), rec)
+    if err := renderPage(c, config, http.StatusOK, "", "<p>content</p>"); err != nil {
+      t.Fatalf("renderPage: %v", err)
+    }
+
+    hasMeta := strings.Contains(rec.Body.String(), `<meta name="robots" content="noindex">`)
+    if hasMeta == allow {
+      t.Errorf("allow_indexing %v: robots meta tag present = %v", allow, hasMeta)
+    }
+    if blocked := strings.Contains(robotsTxt(config), "Disallow: /"); blocked == allow {
+      t.Errorf("allow_indexing %v: robots.txt disallows everything = %v", allow, blocked)
+    }
+  }
+}
+
+// hungHandler never answers, until the client gives up
+func hungHandler(w http.ResponseWriter, r *http.Request) {
+  <-r.Context().Done()
+}
+
+func TestFetchTimeoutCountsAsFailure(t *testing.T) {
+  newFakeAdGuard(t, "  timeout: 1\n", map[string]http.HandlerFunc{"/control/stats": hungHandler})
+
+  start := time.Now()
+  if _, err := fetchStats(t.Context(), currentConfig(), nil); !errors.Is(err, context.DeadlineExceeded) {
+    t.Fatalf("fetchStats error %v, want a deadline exceeded", err)
+  }
+  if elapsed := time.Since(start); elapsed > 5*time.Second {
+    t.Errorf("fetchStats took %v with a 1s timeout", elapsed)
+  }
+  if status := breaker.status(time.Minute); status.Failures != 1 {
+    t.Errorf("breaker failures %d after a timeout, want 1", status.Failures)
+  }
+}
+
+func TestCanceledFetchIsNotAFailure(t *testing.T) {
+  newFakeAdGuard(t, "", nil)
+
+  ctx, cancel := context.WithCancel(t.Context())
+  cancel()
+  if _, err := fetchStats(ctx, currentConfig(), nil); !errors.Is(err, context.Canceled) {
+    t.Fatalf("fetchStats error %v, want context.Canceled", err)
+  }
+  if status := breaker.status(time.Minute); status.Failures != 0 {
+    t.Errorf("breaker failures %d after a canceled request, want 0", status.Failures)
+  }
+}
+
+func TestCacheLoadReturnsWhenCallerCancels(t *testing.T) {
+  newFakeAdGuard(t, "  timeout: 1\n", map[string]http.HandlerFunc{"/control/stats": hungHandler})
+
+  ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+  defer cancel()
+  start := time.Now()
+  if _, _, err := getStats(ctx, currentConfig()); !errors.Is(err, context.DeadlineExceeded) {
+    t.Fatalf("getStats error %v, want the caller's deadline", err)
+  }
+  if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+    t.Errorf("getStats returned after %v, want right after the caller's deadline", elapsed)
+  }
+
+  // Waiting again joins the abandoned fetch, so it has ended before the next test swaps the client
+  if _, _, err := getStats(t.Context(), currentConfig()); err == nil {
+    t.Error("getStats succeeded against a hung AdGuard Home")
+  }
+}
+
+func TestServerTimingReportsTimedFetches(t *testing.T) {
+  templates, err := template.ParseFS(templateFS, requiredTemplates...)
+  if err != nil {
+    t.Fatalf("ParseFS: %v", err)
+  }
+  e := echo.New()
+  e.Renderer = &Template{templates: templates}
+  config := useConfig(t, "adguard:\n  server_url: \"http://127.0.0.1:1\"\nserver:\n  debug_timings: true\n")
+
+  rec := httptest.NewRecorder()
+  c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+  stop := timeFetch(c)
+  time.Sleep(20 * time.Millisecond)
+  stop()
+  if err := renderPage(c, config, http.StatusOK, "", "<p>content</p>"); err != nil {
+    t.Fatalf("renderPage: %v", err)
+  }
+
+  header := rec.Header().Get("Server-Timing")
+  var fetch, render float64
+  if _, err := fmt.Sscanf(header, `fetch;desc="AdGuard Home fetch";dur=%g, render;desc="Template render";dur=%g`, &fetch, &render); err != nil {
+    t.Fatalf("Server-Timing %q: %v", header, err)
+  }
+  if fetch < 20 {
+    t.Errorf("fetch took %gms, want at least the 20ms timed", fetch)
+  }
+
+  // A streamed page sends its headers before the rows are fetched, so it has no timings
+  rec = httptest.NewRecorder()
+  c = e.NewContext(httptest.NewRequest(http.MethodGet, "/querylog", nil), rec)
+  if err := streamPage(c, config, http.StatusOK, "Query Log", func(w io.Writer) error { return nil }); err != nil {
+    t.Fatalf("streamPage: %v", err)
+  }
+  if header := rec.Header().Get("Server-Timing"); header != "" {
+    t.Errorf("streamed page has Server-Timing %q", header)
+  }
+}
+
+func TestAnonymizedPagesOmitPageURL(t *testing.T) {
+  templates, err := template.ParseFS(templateFS, requiredTemplates...)
+  if err != nil {
+    t.Fatalf("ParseFS: %v", err)
+  }
+  e := echo.New()
+  e.Renderer = &Template{templates: templates}
+  config := useDefaultConfig(t)
+
+  for _, tc := range []struct {
+    target string
+    wantIP bool
+  }{
+    {"/clients/192.168.1.10", true},
+    {"/clients/192.168.1.10?anonymize=1", false},
+  } {
+    rec := httptest.NewRecorder()
+    c := e.NewContext(httptest.NewRequest(http.MethodGet, tc.target, nil), rec)
+    if err := renderPage(c, config, http.StatusOK, "laptop", "<p>content</p>"); err != nil {
+      t.Fatalf("%s: renderPage: %v", tc.target, err)
+    }
+    if hasIP := strings.Contains(rec.Body.String(), "192.168.1.10"); hasIP != tc.wantIP {
+      t.Errorf("%s: page contains the client IP = %v, want %v", tc.target, hasIP, tc.wantIP)
+    }
+  }
+}
+
+func TestStatsPageKeysCoverQuerySamples(t *testing.T) {
+  useDefaultConfig(t)
+
+  for _, key := range []string{"stats", "querysample", "blockedclients", "clients"} {
+    cache.set(key, key)
+  }
+  cache.invalidate(statsPageKeys...)
+
+  for _, key := range []string{"stats", "querysample", "blockedclients"} {
+    if _, ok := cache.get(key, time.Hour); ok {
+      t.Errorf("%q is still cached after invalidating the stats page", key)
+    }
+  }
+  if _, ok := cache.get("clients", time.Hour); !ok {
+    t.Error(`"clients" was dropped with the stats page`)
+  }
+}